@@ -0,0 +1,159 @@
+package filedb
+
+import (
+	"sync"
+
+	"github.com/google/btree"
+)
+
+// IndexKind selects the data structure FileIndexConfig maintains for a
+// field: the original hash map (equality lookups only) or a B-tree that
+// also supports ordered range queries.
+type IndexKind int
+
+const (
+	IndexHash IndexKind = iota
+	IndexBTree
+)
+
+// BTreeIterator streams IndexEntry values from a BTreeIndex in key order.
+// Ranging over it (for entry := range it) drains the iterator; abandoning
+// it part-way leaks the backing goroutine, so callers that break early
+// should drain the channel first.
+type BTreeIterator[T FileEntity] <-chan *IndexEntry
+
+type btreeNode struct {
+	key     string
+	entries []*IndexEntry
+}
+
+// BTreeIndex is a B-tree-backed secondary index that keeps entries sorted
+// by a user-supplied less func instead of a hash map, so callers can run
+// ordered range queries (Ascend/Descend/Range) without a full table scan.
+type BTreeIndex[T FileEntity] struct {
+	tree *btree.BTreeG[*btreeNode]
+	less func(a, b string) bool
+	// mu guards tree: Insert/Delete take it exclusively, and every
+	// iteration method snapshots the entries it will stream under a read
+	// lock before handing them to the caller, so a concurrent Insert/
+	// Delete can never mutate a node an in-flight iterator is reading.
+	mu sync.RWMutex
+}
+
+// NewBTreeIndex creates a BTreeIndex ordered by less; a nil less falls
+// back to lexicographic string order.
+func NewBTreeIndex[T FileEntity](less func(a, b string) bool) *BTreeIndex[T] {
+	if less == nil {
+		less = func(a, b string) bool { return a < b }
+	}
+	nodeLess := func(a, b *btreeNode) bool { return less(a.key, b.key) }
+	return &BTreeIndex[T]{
+		tree: btree.NewG(32, nodeLess),
+		less: less,
+	}
+}
+
+func (b *BTreeIndex[T]) Insert(entry *IndexEntry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	node, ok := b.tree.Get(&btreeNode{key: entry.Value})
+	if !ok {
+		node = &btreeNode{key: entry.Value}
+	}
+	node.entries = append(node.entries, entry)
+	b.tree.ReplaceOrInsert(node)
+}
+
+// Delete removes the entry with the given id from the node at key,
+// dropping the node itself once it has no entries left.
+func (b *BTreeIndex[T]) Delete(key string, id int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	node, ok := b.tree.Get(&btreeNode{key: key})
+	if !ok {
+		return
+	}
+	for i, entry := range node.entries {
+		if entry.ID == id {
+			node.entries = append(node.entries[:i], node.entries[i+1:]...)
+			break
+		}
+	}
+	if len(node.entries) == 0 {
+		b.tree.Delete(&btreeNode{key: key})
+		return
+	}
+	b.tree.ReplaceOrInsert(node)
+}
+
+// snapshot walks the tree via iterate under a read lock, copying out every
+// entry it visits, and returns the result once the walk (and the lock it
+// held) is done. Streaming from this fixed slice afterwards means a
+// consumer that reads slowly, or abandons the iterator part-way, never
+// holds mu and so can't block a writer.
+func (b *BTreeIndex[T]) snapshot(iterate func(func(*btreeNode) bool)) []*IndexEntry {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	var entries []*IndexEntry
+	iterate(func(node *btreeNode) bool {
+		entries = append(entries, node.entries...)
+		return true
+	})
+	return entries
+}
+
+func (b *BTreeIndex[T]) stream(entries []*IndexEntry) BTreeIterator[T] {
+	ch := make(chan *IndexEntry)
+	go func() {
+		defer close(ch)
+		for _, entry := range entries {
+			ch <- entry
+		}
+	}()
+	return ch
+}
+
+// Ascend streams every entry in ascending key order.
+func (b *BTreeIndex[T]) Ascend() BTreeIterator[T] {
+	return b.stream(b.snapshot(func(f func(*btreeNode) bool) { b.tree.Ascend(f) }))
+}
+
+// Descend streams every entry in descending key order.
+func (b *BTreeIndex[T]) Descend() BTreeIterator[T] {
+	return b.stream(b.snapshot(func(f func(*btreeNode) bool) { b.tree.Descend(f) }))
+}
+
+// AscendAfter streams entries with a key strictly greater than pivot, in
+// ascending order.
+func (b *BTreeIndex[T]) AscendAfter(pivot string) BTreeIterator[T] {
+	entries := b.snapshot(func(f func(*btreeNode) bool) {
+		b.tree.AscendGreaterOrEqual(&btreeNode{key: pivot}, func(node *btreeNode) bool {
+			if node.key == pivot {
+				return true
+			}
+			return f(node)
+		})
+	})
+	return b.stream(entries)
+}
+
+// DescendBefore streams entries with a key strictly less than pivot, in
+// descending order.
+func (b *BTreeIndex[T]) DescendBefore(pivot string) BTreeIterator[T] {
+	entries := b.snapshot(func(f func(*btreeNode) bool) {
+		b.tree.DescendLessOrEqual(&btreeNode{key: pivot}, func(node *btreeNode) bool {
+			if node.key == pivot {
+				return true
+			}
+			return f(node)
+		})
+	})
+	return b.stream(entries)
+}
+
+// Range streams entries with lo <= key < hi, in ascending order.
+func (b *BTreeIndex[T]) Range(lo, hi string) BTreeIterator[T] {
+	return b.stream(b.snapshot(func(f func(*btreeNode) bool) {
+		b.tree.AscendRange(&btreeNode{key: lo}, &btreeNode{key: hi}, f)
+	}))
+}
@@ -3,16 +3,120 @@ package filedb
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"os"
-	"path/filepath"
 	"slices"
+	"sort"
 	"strings"
+	"sync"
+
+	"github.com/dannyswat/filedb/storage"
 )
 
 type FileIndexConfig struct {
-	Unique  bool
+	Unique bool
+	// Field names a single-field index. Kept for backward compatibility;
+	// new composite indexes should set Fields instead.
 	Field   string
 	Include []string
+	// Fields names a composite/multi-field index (e.g. {"Status", "City"}).
+	// When set it takes precedence over Field. The lookup value passed to
+	// FindId/SearchId/SearchIndex/FindComposite must supply one value per
+	// entry in Fields, in order.
+	Fields []string
+	// Where restricts this index to a subset of records, e.g. only ones
+	// where Status == "active". A record for which Where returns false is
+	// left out of this index entirely, the same as if it didn't exist.
+	Where func(FileEntity) bool
+	// Kind selects the in-memory structure maintained for this field.
+	// IndexHash (the default) only supports equality lookups; IndexBTree
+	// also supports ordered range queries via FileDB.ListRange /
+	// ListAscendAfter.
+	Kind IndexKind
+	// Less orders values for an IndexBTree config. Nil falls back to
+	// lexicographic string order; set it to compare numerically for
+	// fields like Age where "9" should sort before "10".
+	Less func(a, b string) bool
+}
+
+// Name identifies this index for persistence and lookups: the single
+// field for a legacy config, or the Fields joined with "+" for a
+// composite one.
+func (ic *FileIndexConfig) Name() string {
+	if len(ic.Fields) > 0 {
+		return strings.Join(ic.Fields, "+")
+	}
+	return ic.Field
+}
+
+// fieldList returns the fields this index is keyed on, whether it was
+// declared with the legacy Field or the composite Fields.
+func (ic *FileIndexConfig) fieldList() []string {
+	if len(ic.Fields) > 0 {
+		return ic.Fields
+	}
+	return []string{ic.Field}
+}
+
+// matches reports whether e belongs in this index at all, honoring an
+// optional partial-index Where predicate.
+func (ic *FileIndexConfig) matches(e FileEntity) bool {
+	return ic.Where == nil || ic.Where(e)
+}
+
+// compositeKey joins one value per field into a single index key. Each
+// value is backslash-escaped first so a literal tab or newline inside a
+// field value can't be mistaken for the separator between fields.
+func compositeKey(values []string) string {
+	escaped := make([]string, len(values))
+	for i, v := range values {
+		escaped[i] = escapeKeyPart(v)
+	}
+	return strings.Join(escaped, "\t")
+}
+
+func escapeKeyPart(v string) string {
+	v = strings.ReplaceAll(v, "\\", "\\\\")
+	v = strings.ReplaceAll(v, "\t", "\\t")
+	v = strings.ReplaceAll(v, "\n", "\\n")
+	return v
+}
+
+// unescapeKeyPart reverses escapeKeyPart. Doubled backslashes are
+// unambiguous as long as every single backslash in the escaped string
+// started an escape sequence, which escapeKeyPart guarantees.
+func unescapeKeyPart(v string) string {
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		if v[i] == '\\' && i+1 < len(v) {
+			switch v[i+1] {
+			case '\\':
+				b.WriteByte('\\')
+				i++
+				continue
+			case 't':
+				b.WriteByte('\t')
+				i++
+				continue
+			case 'n':
+				b.WriteByte('\n')
+				i++
+				continue
+			}
+		}
+		b.WriteByte(v[i])
+	}
+	return b.String()
+}
+
+// indexValue returns e's composite lookup key for this config.
+func (ic *FileIndexConfig) indexValue(e FileEntity) string {
+	fields := ic.fieldList()
+	values := make([]string, len(fields))
+	for i, f := range fields {
+		values[i] = e.GetValue(f)
+	}
+	return compositeKey(values)
 }
 
 type IndexEntry struct {
@@ -21,61 +125,139 @@ type IndexEntry struct {
 	Others map[string]string
 }
 
+// allIdsIndexName names an internal, always-matching index that every
+// fileIndex maintains alongside the caller-configured ones, in the same
+// indexes map and persisted the same way. ListAllIds and FindMaxIdAndCount
+// read it instead of indexConfigs[0] or a map-iteration-order guess, so a
+// partial Where index (or none at all) can never make either of those
+// under-report the full record set.
+const allIdsIndexName = "__allids__"
+
 type FileIndex[T FileEntity] interface {
 	Init() error
 	RebuildIndex(config *FileIndexConfig) error
 	Insert(e T) error
 	Update(e, prev T) error
 	Delete(prev T) error
-	FindId(field string, value string) int
-	SearchId(field string, value string) []int
-	SearchIndex(field string, value string) []*IndexEntry
+	// FindId/SearchId/SearchIndex take one value per field of a composite
+	// index, in the order its Fields (or the single Field) were declared.
+	FindId(field string, values ...string) int
+	SearchId(field string, values ...string) []int
+	SearchIndex(field string, values ...string) []*IndexEntry
 	SearchAllIndex(field string) []*IndexEntry
+	// ValidateInsert reports the error Insert would return for e (e.g. a
+	// unique index violation) without mutating any index, so a caller can
+	// reject an invalid record before making it durable.
+	ValidateInsert(e T) error
+	// ValidateUpdate reports the error Update would return for e replacing
+	// prev, without mutating any index.
+	ValidateUpdate(e, prev T) error
+	// GetIndexConfig returns the config registered under name (its Name()),
+	// or nil if no index with that name was configured.
+	GetIndexConfig(name string) *FileIndexConfig
 	FindMaxIdAndCount() (int, int)
 	ListAllIds() []int
+	// RebuildAll rebuilds every configured index, including the internal
+	// complete-record one ListAllIds/FindMaxIdAndCount read, from the
+	// object files on disk. Callers that already know every index needs a
+	// rebuild (e.g. FileDB.Init after WAL replay) should prefer this over
+	// calling RebuildIndex once per config, since it also repopulates the
+	// B-tree for any IndexBTree-kind config.
+	RebuildAll() error
+	// Checkpoint rewrites every index file atomically (write-then-rename)
+	// and is the recovery point WAL replay fast-forwards to.
+	Checkpoint() error
+	// Ascend/Descend/AscendAfter/DescendBefore/Range stream entries in
+	// sorted order from an IndexBTree-kind field; they yield a closed,
+	// empty iterator for a field that isn't configured as a B-tree.
+	Ascend(field string) BTreeIterator[T]
+	Descend(field string) BTreeIterator[T]
+	AscendAfter(field, pivot string) BTreeIterator[T]
+	DescendBefore(field, pivot string) BTreeIterator[T]
+	Range(field, lo, hi string) BTreeIterator[T]
 }
 
 type fileIndex[T FileEntity] struct {
 	path         string
 	indexConfigs []FileIndexConfig
 	indexes      map[string]map[string][]*IndexEntry
+	btrees       map[string]*BTreeIndex[T]
+	storage      storage.Storage
+	codec        IndexCodec
+	// mu guards indexes/btrees: Insert/Update/Delete, the Validate*, lookup
+	// and B-tree methods, RebuildIndex, FindMaxIdAndCount, ListAllIds and
+	// Checkpoint take it, so concurrent Insert/Update/Delete calls for
+	// different IDs (serialized from each other only by fileDB's per-ID
+	// locks) can't race on this shared state. Init, Load, LoadIndex, Save
+	// and RebuildAll's B-tree step do not take it; Save runs with it already
+	// held by Update/Delete.
+	mu sync.RWMutex
 }
 
-func NewFileIndex[T FileEntity](path string, indexConfig []FileIndexConfig) FileIndex[T] {
+// NewFileIndex builds a FileIndex over indexConfig, reading and writing
+// index files through s. codec optionally overrides how index files are
+// serialized; with none given it defaults to TabIndexCodec, the escaped
+// tab-separated format.
+func NewFileIndex[T FileEntity](path string, indexConfig []FileIndexConfig, s storage.Storage, codec ...IndexCodec) FileIndex[T] {
+	configs := make([]FileIndexConfig, len(indexConfig)+1)
+	copy(configs, indexConfig)
+	configs[len(indexConfig)] = FileIndexConfig{Field: allIdsIndexName}
 	fi := &fileIndex[T]{
 		path:         path,
-		indexConfigs: indexConfig,
+		indexConfigs: configs,
 		indexes:      make(map[string]map[string][]*IndexEntry),
+		btrees:       make(map[string]*BTreeIndex[T]),
+		storage:      s,
+		codec:        TabIndexCodec{},
+	}
+	if len(codec) > 0 {
+		fi.codec = codec[0]
 	}
-	for _, ic := range indexConfig {
-		fi.indexes[ic.Field] = make(map[string][]*IndexEntry)
+	for _, ic := range configs {
+		fi.indexes[ic.Name()] = make(map[string][]*IndexEntry)
+		if ic.Kind == IndexBTree {
+			fi.btrees[ic.Name()] = NewBTreeIndex[T](ic.Less)
+		}
 	}
 	return fi
 }
 
+// RebuildAll rebuilds every configured index, including allIdsIndexName,
+// from the object files on disk, and repopulates any B-tree alongside it.
+func (fi *fileIndex[T]) RebuildAll() error {
+	for i := range fi.indexConfigs {
+		if err := fi.RebuildIndex(&fi.indexConfigs[i]); err != nil {
+			return err
+		}
+		fi.rebuildBTree(&fi.indexConfigs[i])
+	}
+	return nil
+}
+
 func (fi *fileIndex[T]) Init() error {
 	for _, ic := range fi.indexConfigs {
-		if _, err := os.Stat(fi.GetPath(ic.Field)); os.IsNotExist(err) {
-			file, err := os.OpenFile(fi.GetPath(ic.Field), os.O_CREATE, 0644)
+		if !fi.storage.Exists(fi.GetPath(ic.Name())) {
+			file, err := fi.storage.Create(fi.GetPath(ic.Name()))
 			if err != nil {
 				return err
 			}
-			defer file.Close()
 			err = fi.RebuildIndex(&ic)
 			if err != nil {
+				file.Close()
 				return err
 			}
-			for k, v := range fi.indexes[ic.Field] {
-				for _, entry := range v {
-					file.WriteString(fmt.Sprintf("%s\t%d", k, entry.ID))
-					for _, i := range ic.Include {
-						file.WriteString(fmt.Sprintf("\t%s", entry.Others[i]))
+			values := fi.indexes[ic.Name()]
+			for _, k := range fi.sortedKeys(ic.Name()) {
+				for _, entry := range values[k] {
+					if err := fi.codec.EncodeEntry(file, k, entry); err != nil {
+						file.Close()
+						return err
 					}
-					file.WriteString("\n")
 				}
 			}
+			file.Close()
 		} else {
-			if err = fi.LoadIndex(ic.Field); err != nil {
+			if err := fi.LoadIndex(ic.Name()); err != nil {
 				_, ok := err.(*InvalidIndexError)
 				if !ok {
 					return err
@@ -85,16 +267,56 @@ func (fi *fileIndex[T]) Init() error {
 				}
 			}
 		}
+		fi.rebuildBTree(&ic)
 	}
 	return nil
 }
 
 func (fi *fileIndex[T]) RebuildIndex(config *FileIndexConfig) error {
-	fi.indexes[config.Field] = make(map[string][]*IndexEntry)
-	fi.rebuildIndexInternal(config.Field, "", config.Include, fi.indexes[config.Field])
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.indexes[config.Name()] = make(map[string][]*IndexEntry)
+	fi.rebuildIndexInternal(config, "", fi.indexes[config.Name()])
 	return nil
 }
 
+// sortedKeys returns name's index keys in ascending order: by the index's
+// own Less when it has a B-tree, otherwise lexically. Init, Save and
+// Checkpoint write index files in this order; Insert appends new entries
+// at the end of the file instead.
+func (fi *fileIndex[T]) sortedKeys(name string) []string {
+	values := fi.indexes[name]
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	if bt, ok := fi.btrees[name]; ok {
+		sort.Slice(keys, func(i, j int) bool { return bt.less(keys[i], keys[j]) })
+	} else {
+		sort.Strings(keys)
+	}
+	return keys
+}
+
+// rebuildBTree repopulates the B-tree for an IndexBTree-kind config.
+// google/btree has no bulk-load API, so this is O(n log n) regardless of
+// input order: one ReplaceOrInsert per entry. Values are inserted in the
+// order sortedKeys returns, which it sorts afresh on every call; the order
+// of entries in the index file plays no part.
+func (fi *fileIndex[T]) rebuildBTree(config *FileIndexConfig) {
+	bt, ok := fi.btrees[config.Name()]
+	if !ok {
+		return
+	}
+	values := fi.indexes[config.Name()]
+	bt.tree.Clear(false)
+	for _, k := range fi.sortedKeys(config.Name()) {
+		for _, entry := range values[k] {
+			bt.Insert(entry)
+		}
+	}
+}
+
 func getFields(e FileEntity, includes []string) map[string]string {
 	fields := make(map[string]string)
 	for _, f := range includes {
@@ -103,88 +325,174 @@ func getFields(e FileEntity, includes []string) map[string]string {
 	return fields
 }
 
-func createIndexEntry(e FileEntity, field string, includes []string) *IndexEntry {
+func createIndexEntry(e FileEntity, config *FileIndexConfig) *IndexEntry {
 	return &IndexEntry{
-		Value:  e.GetValue(field),
+		Value:  config.indexValue(e),
 		ID:     e.GetID(),
-		Others: getFields(e, includes),
+		Others: getFields(e, config.Include),
 	}
 }
 
-func (fi *fileIndex[T]) rebuildIndexInternal(field, path string, includes []string, index map[string][]*IndexEntry) error {
-	entries, err := os.ReadDir(filepath.FromSlash(fi.path + path))
+func (fi *fileIndex[T]) rebuildIndexInternal(config *FileIndexConfig, path string, index map[string][]*IndexEntry) error {
+	entries, err := fi.storage.List(fi.path + path)
 	if err != nil {
 		return err
 	}
-	for _, entry := range entries {
-		if entry.IsDir() {
-			fi.rebuildIndexInternal(field, path+"/"+entry.Name(), includes, index)
-		} else {
-			var e T
-			if e, err = ReadObject[T](fi.path + path + "/" + entry.Name()); err != nil {
+	for _, name := range entries {
+		fullPath := fi.path + path + "/" + name
+		if _, err := fi.storage.List(fullPath); err == nil {
+			if err := fi.rebuildIndexInternal(config, path+"/"+name, index); err != nil {
 				return err
 			}
-			index[e.GetValue(field)] = append(
-				index[e.GetValue(field)],
-				createIndexEntry(e, field, includes))
+			continue
+		}
+		var e T
+		if e, err = ReadObject[T](fi.storage, fullPath); err != nil {
+			return err
 		}
+		if !config.matches(e) {
+			continue
+		}
+		key := config.indexValue(e)
+		index[key] = append(index[key], createIndexEntry(e, config))
 	}
 
 	return nil
 }
 
-func (fi *fileIndex[T]) Insert(e T) error {
+// ValidateInsert reports the unique-index violation Insert would hit for e,
+// without mutating fi.indexes, so a caller can refuse to make e durable
+// (e.g. append it to the WAL) before it's known to be insertable.
+func (fi *fileIndex[T]) ValidateInsert(e T) error {
+	fi.mu.RLock()
+	defer fi.mu.RUnlock()
+	return fi.validateInsertLocked(e)
+}
+
+func (fi *fileIndex[T]) validateInsertLocked(e T) error {
 	for _, ic := range fi.indexConfigs {
+		if !ic.matches(e) {
+			continue
+		}
 		if ic.Unique {
-			if idx, ok := fi.indexes[ic.Field][e.GetValue(ic.Field)]; ok && len(idx) > 0 {
-				return fmt.Errorf("unique index violation: %s", ic.Field)
+			if idx, ok := fi.indexes[ic.Name()][ic.indexValue(e)]; ok && len(idx) > 0 {
+				return fmt.Errorf("unique index violation: %s", ic.Name())
 			}
 		}
 	}
+	return nil
+}
+
+func (fi *fileIndex[T]) Insert(e T) error {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	if err := fi.validateInsertLocked(e); err != nil {
+		return err
+	}
 
 	for _, ic := range fi.indexConfigs {
-		index, ok := fi.indexes[ic.Field][e.GetValue(ic.Field)]
+		if !ic.matches(e) {
+			continue
+		}
+		key := ic.indexValue(e)
+		index, ok := fi.indexes[ic.Name()][key]
 		if !ok {
 			index = make([]*IndexEntry, 0)
 		}
-		index = append(index, createIndexEntry(e, ic.Field, ic.Include))
-		fi.indexes[ic.Field][e.GetValue(ic.Field)] = index
-		file, err := os.OpenFile(fi.GetPath(ic.Field), os.O_WRONLY|os.O_APPEND, 0644)
+		entry := createIndexEntry(e, &ic)
+		index = append(index, entry)
+		fi.indexes[ic.Name()][key] = index
+		if bt, ok := fi.btrees[ic.Name()]; ok {
+			bt.Insert(entry)
+		}
+		file, err := fi.storage.Open(fi.GetPath(ic.Name()), os.O_WRONLY|os.O_APPEND, 0644)
 		if err != nil {
 			return err
 		}
-		defer file.Close()
-		file.WriteString(fmt.Sprintf("%s\t%d", e.GetValue(ic.Field), e.GetID()))
-		for _, i := range ic.Include {
-			file.WriteString(fmt.Sprintf("\t%s", e.GetValue(i)))
+		err = fi.codec.EncodeEntry(file, key, entry)
+		file.Close()
+		if err != nil {
+			return err
 		}
-		file.WriteString("\n")
 	}
 	return nil
 }
 
-func (fi *fileIndex[T]) Update(e, prev T) error {
+// ValidateUpdate reports the unique-index violation Update would hit for e
+// replacing prev, without mutating fi.indexes, so a caller can refuse to
+// make e durable (e.g. append it to the WAL) before it's known to be
+// applicable.
+func (fi *fileIndex[T]) ValidateUpdate(e, prev T) error {
+	fi.mu.RLock()
+	defer fi.mu.RUnlock()
+	return fi.validateUpdateLocked(e, prev)
+}
 
-	// Validation
+func (fi *fileIndex[T]) validateUpdateLocked(e, prev T) error {
 	for _, ic := range fi.indexConfigs {
-		if e.GetValue(ic.Field) == prev.GetValue(ic.Field) {
+		if !ic.matches(e) {
+			continue
+		}
+		// A record entering a partial index's Where (!prevMatched) can
+		// collide on an unchanged key value, since prev never held an
+		// entry under this index to begin with. Treat that transition
+		// like an insert and check it even when the key didn't change.
+		if ic.matches(prev) && ic.indexValue(e) == ic.indexValue(prev) {
 			continue
 		}
 		if ic.Unique {
-			if idx, ok := fi.indexes[ic.Field][e.GetValue(ic.Field)]; ok && len(idx) > 0 {
-				return fmt.Errorf("unique index violation: %s", ic.Field)
+			if idx, ok := fi.indexes[ic.Name()][ic.indexValue(e)]; ok && len(idx) > 0 {
+				return fmt.Errorf("unique index violation: %s", ic.Name())
 			}
 		}
 	}
+	return nil
+}
+
+func (fi *fileIndex[T]) Update(e, prev T) error {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	if err := fi.validateUpdateLocked(e, prev); err != nil {
+		return err
+	}
 	idComparer := func(item *IndexEntry) bool {
 		return prev.GetID() == item.ID
 	}
 
 	// Update index
 	for _, ic := range fi.indexConfigs {
-		indexFile := fi.indexes[ic.Field]
-		newKeyValue := e.GetValue(ic.Field)
-		oldKeyValue := prev.GetValue(ic.Field)
+		indexFile := fi.indexes[ic.Name()]
+		prevMatched := ic.matches(prev)
+		matched := ic.matches(e)
+		newKeyValue := ic.indexValue(e)
+		oldKeyValue := ic.indexValue(prev)
+
+		if !prevMatched && !matched {
+			continue
+		}
+		if prevMatched && !matched {
+			// No longer satisfies the partial index's Where: drop it.
+			oldIndexEntries := indexFile[oldKeyValue]
+			oldEntryIndex := slices.IndexFunc(oldIndexEntries, idComparer)
+			oldIndexEntries = append(oldIndexEntries[:oldEntryIndex], oldIndexEntries[oldEntryIndex+1:]...)
+			indexFile[oldKeyValue] = oldIndexEntries
+			if bt, ok := fi.btrees[ic.Name()]; ok {
+				bt.Delete(oldKeyValue, prev.GetID())
+			}
+			fi.Save(ic.Name())
+			continue
+		}
+		if !prevMatched && matched {
+			// Newly satisfies the partial index's Where: add it.
+			newEntry := createIndexEntry(e, &ic)
+			indexFile[newKeyValue] = append(indexFile[newKeyValue], newEntry)
+			if bt, ok := fi.btrees[ic.Name()]; ok {
+				bt.Insert(newEntry)
+			}
+			fi.Save(ic.Name())
+			continue
+		}
+
 		if newKeyValue == oldKeyValue {
 			// No change in index field, check if include fields have changed
 			indexEntries := indexFile[newKeyValue]
@@ -198,7 +506,7 @@ func (fi *fileIndex[T]) Update(e, prev T) error {
 			}
 			if changed {
 				indexFile[newKeyValue] = indexEntries
-				fi.Save(ic.Field)
+				fi.Save(ic.Name())
 			}
 			continue
 		}
@@ -208,28 +516,45 @@ func (fi *fileIndex[T]) Update(e, prev T) error {
 		oldEntryIndex := slices.IndexFunc(oldIndexEntries, idComparer)
 		oldIndexEntries = append(oldIndexEntries[:oldEntryIndex], oldIndexEntries[oldEntryIndex+1:]...)
 		indexFile[oldKeyValue] = oldIndexEntries
-		indexFile[newKeyValue] = append(indexFile[newKeyValue], createIndexEntry(e, ic.Field, ic.Include))
-		fi.Save(ic.Field)
+		newEntry := createIndexEntry(e, &ic)
+		indexFile[newKeyValue] = append(indexFile[newKeyValue], newEntry)
+		if bt, ok := fi.btrees[ic.Name()]; ok {
+			bt.Delete(oldKeyValue, prev.GetID())
+			bt.Insert(newEntry)
+		}
+		fi.Save(ic.Name())
 	}
 	return nil
 }
 
 func (fi *fileIndex[T]) Delete(prev T) error {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
 	idComparer := func(item *IndexEntry) bool {
 		return prev.GetID() == item.ID
 	}
 	for _, ic := range fi.indexConfigs {
-		index := fi.indexes[ic.Field][prev.GetValue(ic.Field)]
+		if !ic.matches(prev) {
+			continue
+		}
+		value := ic.indexValue(prev)
+		index := fi.indexes[ic.Name()][value]
 		ci := slices.IndexFunc(index, idComparer)
 		index = append(index[:ci], index[ci+1:]...)
-		fi.indexes[ic.Field][prev.GetValue(ic.Field)] = index
-		fi.Save(ic.Field)
+		fi.indexes[ic.Name()][value] = index
+		if bt, ok := fi.btrees[ic.Name()]; ok {
+			bt.Delete(value, prev.GetID())
+		}
+		fi.Save(ic.Name())
 	}
 	return nil
 }
 
-func (fi *fileIndex[T]) FindId(field string, value string) int {
-	if index, ok := fi.indexes[field][value]; ok {
+func (fi *fileIndex[T]) FindId(field string, values ...string) int {
+	fi.mu.RLock()
+	defer fi.mu.RUnlock()
+	key := compositeKey(values)
+	if index, ok := fi.indexes[field][key]; ok {
 		if len(index) > 0 {
 			return index[0].ID
 		}
@@ -237,8 +562,11 @@ func (fi *fileIndex[T]) FindId(field string, value string) int {
 	return 0
 }
 
-func (fi *fileIndex[T]) SearchId(field string, value string) []int {
-	if index, ok := fi.indexes[field][value]; ok {
+func (fi *fileIndex[T]) SearchId(field string, values ...string) []int {
+	fi.mu.RLock()
+	defer fi.mu.RUnlock()
+	key := compositeKey(values)
+	if index, ok := fi.indexes[field][key]; ok {
 		ids := make([]int, len(index))
 		for i, v := range index {
 			ids[i] = v.ID
@@ -248,14 +576,19 @@ func (fi *fileIndex[T]) SearchId(field string, value string) []int {
 	return nil
 }
 
-func (fi *fileIndex[T]) SearchIndex(field string, value string) []*IndexEntry {
-	if index, ok := fi.indexes[field][value]; ok {
+func (fi *fileIndex[T]) SearchIndex(field string, values ...string) []*IndexEntry {
+	fi.mu.RLock()
+	defer fi.mu.RUnlock()
+	key := compositeKey(values)
+	if index, ok := fi.indexes[field][key]; ok {
 		return index
 	}
 	return nil
 }
 
 func (fi *fileIndex[T]) SearchAllIndex(field string) []*IndexEntry {
+	fi.mu.RLock()
+	defer fi.mu.RUnlock()
 	var result []*IndexEntry
 	for _, v := range fi.indexes[field] {
 		result = append(result, v...)
@@ -265,7 +598,7 @@ func (fi *fileIndex[T]) SearchAllIndex(field string) []*IndexEntry {
 
 func (fi *fileIndex[T]) Load() error {
 	for _, ic := range fi.indexConfigs {
-		if err := fi.LoadIndex(ic.Field); err != nil {
+		if err := fi.LoadIndex(ic.Name()); err != nil {
 			return err
 		}
 	}
@@ -277,61 +610,82 @@ func (fi *fileIndex[T]) LoadIndex(name string) error {
 	if ic == nil {
 		return fmt.Errorf("index config not found: %s", name)
 	}
-	file, err := os.OpenFile(fi.GetPath(name), os.O_RDONLY, 0644)
+	file, err := fi.storage.Open(fi.GetPath(name), os.O_RDONLY, 0644)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 	fi.indexes[name] = make(map[string][]*IndexEntry)
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if line == "" {
-			continue
+	r := bufio.NewReader(file)
+	for {
+		value, entry, err := fi.codec.DecodeEntry(r)
+		if err == io.EOF {
+			break
 		}
-		var id int
-		var value string
-		parts := strings.Split(line, "\t")
-		if len(parts) != len(ic.Include)+2 {
-			return &InvalidIndexError{Message: "invalid index file format"}
-		}
-		value = parts[0]
-		fmt.Sscanf(parts[1], "%d", &id)
-		others := make(map[string]string)
-		for i := 2; i < len(parts); i++ {
-			others[ic.Include[i-2]] = parts[i]
+		if err != nil {
+			return err
 		}
-		entry := &IndexEntry{Value: value, ID: id, Others: others}
 		fi.indexes[name][value] = append(fi.indexes[name][value], entry)
 	}
 	return nil
 }
 
+// Save rewrites name's index file with keys in sorted order (see
+// sortedKeys). LoadIndex reads the file into a map; it does not load a
+// B-tree from it, and rebuildBTree sorts the keys again.
 func (fi *fileIndex[T]) Save(name string) error {
-	file, err := os.OpenFile(fi.GetPath(name), os.O_WRONLY|os.O_TRUNC, 0644)
+	file, err := fi.storage.Open(fi.GetPath(name), os.O_WRONLY|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
-	for k, v := range fi.indexes[name] {
-		for _, entry := range v {
-			file.WriteString(fmt.Sprintf("%s\t%d", k, entry.ID))
-			for _, i := range fi.GetIndexConfig(name).Include {
-				file.WriteString(fmt.Sprintf("\t%s", entry.Others[i]))
+	values := fi.indexes[name]
+	for _, k := range fi.sortedKeys(name) {
+		for _, entry := range values[k] {
+			if err := fi.codec.EncodeEntry(file, k, entry); err != nil {
+				return err
 			}
-			file.WriteString("\n")
+		}
+	}
+	return nil
+}
+
+// Checkpoint rewrites every index file into a temporary file and renames it
+// into place, so a crash during the write leaves the previous, still-valid
+// index file untouched instead of a half-truncated one.
+func (fi *fileIndex[T]) Checkpoint() error {
+	fi.mu.RLock()
+	defer fi.mu.RUnlock()
+	for _, ic := range fi.indexConfigs {
+		tmpPath := fi.GetPath(ic.Name()) + ".tmp"
+		file, err := fi.storage.Create(tmpPath)
+		if err != nil {
+			return err
+		}
+		values := fi.indexes[ic.Name()]
+		for _, k := range fi.sortedKeys(ic.Name()) {
+			for _, entry := range values[k] {
+				if err := fi.codec.EncodeEntry(file, k, entry); err != nil {
+					file.Close()
+					return err
+				}
+			}
+		}
+		file.Close()
+		if err := fi.storage.Rename(tmpPath, fi.GetPath(ic.Name())); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
 func (fi *fileIndex[T]) GetPath(name string) string {
-	return filepath.FromSlash(fi.path + "/_" + name + ".idx")
+	return fi.path + "/_" + name + ".idx"
 }
 
 func (fi *fileIndex[T]) GetIndexConfig(name string) *FileIndexConfig {
 	for _, ic := range fi.indexConfigs {
-		if ic.Field == name {
+		if ic.Name() == name {
 			return &ic
 		}
 	}
@@ -339,32 +693,85 @@ func (fi *fileIndex[T]) GetIndexConfig(name string) *FileIndexConfig {
 }
 
 func (fi *fileIndex[T]) FindMaxIdAndCount() (int, int) {
+	fi.mu.RLock()
+	defer fi.mu.RUnlock()
 	max := 0
 	count := 0
-	for _, index := range fi.indexes {
-		for _, entries := range index {
-			for _, entry := range entries {
-				if entry.ID > max {
-					max = entry.ID
-				}
+	for _, entries := range fi.indexes[allIdsIndexName] {
+		for _, entry := range entries {
+			if entry.ID > max {
+				max = entry.ID
 			}
-			count = count + len(entries)
 		}
-		break
+		count = count + len(entries)
 	}
 	return max, count
 }
 
 func (fi *fileIndex[T]) ListAllIds() []int {
+	fi.mu.RLock()
+	defer fi.mu.RUnlock()
 	ids := make([]int, 0)
-	if len(fi.indexConfigs) == 0 {
-		return ids
-	}
-	index := fi.indexes[fi.indexConfigs[0].Field]
-	for _, entries := range index {
+	for _, entries := range fi.indexes[allIdsIndexName] {
 		for _, entry := range entries {
 			ids = append(ids, entry.ID)
 		}
 	}
 	return ids
 }
+
+func closedBTreeIterator[T FileEntity]() BTreeIterator[T] {
+	ch := make(chan *IndexEntry)
+	close(ch)
+	return ch
+}
+
+func (fi *fileIndex[T]) Ascend(field string) BTreeIterator[T] {
+	fi.mu.RLock()
+	bt, ok := fi.btrees[field]
+	fi.mu.RUnlock()
+	if ok {
+		return bt.Ascend()
+	}
+	return closedBTreeIterator[T]()
+}
+
+func (fi *fileIndex[T]) Descend(field string) BTreeIterator[T] {
+	fi.mu.RLock()
+	bt, ok := fi.btrees[field]
+	fi.mu.RUnlock()
+	if ok {
+		return bt.Descend()
+	}
+	return closedBTreeIterator[T]()
+}
+
+func (fi *fileIndex[T]) AscendAfter(field, pivot string) BTreeIterator[T] {
+	fi.mu.RLock()
+	bt, ok := fi.btrees[field]
+	fi.mu.RUnlock()
+	if ok {
+		return bt.AscendAfter(pivot)
+	}
+	return closedBTreeIterator[T]()
+}
+
+func (fi *fileIndex[T]) DescendBefore(field, pivot string) BTreeIterator[T] {
+	fi.mu.RLock()
+	bt, ok := fi.btrees[field]
+	fi.mu.RUnlock()
+	if ok {
+		return bt.DescendBefore(pivot)
+	}
+	return closedBTreeIterator[T]()
+}
+
+func (fi *fileIndex[T]) Range(field, lo, hi string) BTreeIterator[T] {
+	fi.mu.RLock()
+	bt, ok := fi.btrees[field]
+	fi.mu.RUnlock()
+	if ok {
+		return bt.Range(lo, hi)
+	}
+	return closedBTreeIterator[T]()
+}
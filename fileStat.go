@@ -3,7 +3,9 @@ package filedb
 import (
 	"fmt"
 	"os"
-	"path/filepath"
+	"sync"
+
+	"github.com/dannyswat/filedb/storage"
 )
 
 type FileStat[T FileEntity] interface {
@@ -11,43 +13,69 @@ type FileStat[T FileEntity] interface {
 	GetNextID(peek bool) int
 	GetCount() int
 	AddCount(c int) error
+	// BumpNextID advances nextID past id if it isn't already, so a caller
+	// that inserts a specific id (rather than one minted by GetNextID)
+	// can't have that id handed out again later.
+	BumpNextID(id int) error
+	// Reconcile recomputes nextID/count from fi's actual record set and
+	// persists them, discarding whatever was loaded from the stat file.
+	// Callers use this after an operation (e.g. WAL replay) that can change
+	// which records exist out from under a stat file last saved before it.
+	Reconcile(fi FileIndex[T]) error
 }
 
 type fileStat[T FileEntity] struct {
 	path     string
 	statPath string
+	storage  storage.Storage
 	nextID   int
 	count    int
+	// mu guards nextID/count: Insert/Upsert call GetNextID and AddCount for
+	// different, concurrently-running IDs, which fileDB's per-ID locks
+	// don't serialize against each other.
+	mu sync.Mutex
 }
 
-func NewFileStat[T FileEntity](path string) FileStat[T] {
+func NewFileStat[T FileEntity](path string, s storage.Storage) FileStat[T] {
 	return &fileStat[T]{
 		path:     path,
-		statPath: filepath.FromSlash(path + "/_stat.dat"),
+		statPath: path + "/_stat.dat",
+		storage:  s,
 		nextID:   1,
 		count:    0,
 	}
 }
 
 func (fs *fileStat[T]) Init(fi FileIndex[T]) error {
-	if _, err := os.Stat(fs.statPath); os.IsNotExist(err) {
-		file, err := os.OpenFile(fs.statPath, os.O_CREATE, 0644)
+	if !fs.storage.Exists(fs.statPath) {
+		file, err := fs.storage.Create(fs.statPath)
 		if err != nil {
 			return err
 		}
 		fs.nextID, fs.count = fi.FindMaxIdAndCount()
 		fs.nextID++
-		file.WriteString(fmt.Sprintf("%d\n%d\n", fs.nextID, fs.count))
+		fmt.Fprintf(file, "%d\n%d\n", fs.nextID, fs.count)
 		file.Close()
 	} else {
-		if err = fs.Load(); err != nil {
+		if err := fs.Load(); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+func (fs *fileStat[T]) Reconcile(fi FileIndex[T]) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	maxID, count := fi.FindMaxIdAndCount()
+	fs.nextID = maxID + 1
+	fs.count = count
+	return fs.Save()
+}
+
 func (fs *fileStat[T]) GetNextID(peek bool) int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
 	if peek {
 		return fs.nextID
 	}
@@ -57,18 +85,32 @@ func (fs *fileStat[T]) GetNextID(peek bool) int {
 	return id
 }
 
+func (fs *fileStat[T]) BumpNextID(id int) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if id < fs.nextID {
+		return nil
+	}
+	fs.nextID = id + 1
+	return fs.Save()
+}
+
 func (fs *fileStat[T]) GetCount() int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
 	return fs.count
 }
 
 func (fs *fileStat[T]) AddCount(c int) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
 	fs.count += c
 	fs.Save()
 	return nil
 }
 
 func (fs *fileStat[T]) Load() error {
-	file, err := os.Open(fs.statPath)
+	file, err := fs.storage.Open(fs.statPath, os.O_RDONLY, 0644)
 	if err != nil {
 		return err
 	}
@@ -78,11 +120,11 @@ func (fs *fileStat[T]) Load() error {
 }
 
 func (fs *fileStat[T]) Save() error {
-	file, err := os.OpenFile(fs.statPath, os.O_TRUNC|os.O_WRONLY, 0644)
+	file, err := fs.storage.Open(fs.statPath, os.O_TRUNC|os.O_WRONLY, 0644)
 	if err != nil {
 		return err
 	}
-	file.WriteString(fmt.Sprintf("%d\n%d\n", fs.nextID, fs.count))
+	fmt.Fprintf(file, "%d\n%d\n", fs.nextID, fs.count)
 	file.Close()
 	return nil
 }
@@ -1,106 +1,487 @@
 package filedb
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"io"
 	"os"
-	"path/filepath"
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
+
+	"github.com/dannyswat/filedb/replication"
+	"github.com/dannyswat/filedb/storage"
+	"github.com/dannyswat/filedb/wal"
 )
 
+// idLockShards is the number of mutexes Update/Delete/UpdateFunc/Upsert/
+// ApplyReplicated hash an ID into. It only needs to be large enough to keep unrelated
+// IDs from contending with each other; it doesn't bound concurrency for a
+// single ID, which is always serialized regardless of shard count.
+const idLockShards = 32
+
+// checkpointOpThreshold bounds how many WAL records can accumulate before
+// Insert/Update/Delete/Upsert trigger an automatic Checkpoint, so neither
+// the log's on-disk size nor a clean restart's replay cost grows without
+// bound between callers that checkpoint explicitly.
+const checkpointOpThreshold = 1000
+
 type FileDB[T FileEntity] interface {
 	Init() error
 	Insert(e T) error
 	Update(e T) error
 	Delete(id int) error
+	// UpdateFunc atomically loads the record at id, passes it to fn for
+	// in-place mutation, and writes the result back, all under the same
+	// per-ID lock Update and Delete use. Unlike calling Find then Update
+	// directly, another goroutine can't observe or write a stale value in
+	// between. If fn returns an error, the record is left untouched.
+	UpdateFunc(id int, fn func(T) error) error
+	// Upsert atomically loads the record at id if it exists (exists=false
+	// and a zero-valued, ID-set record otherwise), passes it to fn, and
+	// writes back whatever fn returns, inserting or updating as needed.
+	// It holds the same per-ID lock as UpdateFunc.
+	Upsert(id int, fn func(e T, exists bool) (T, error)) error
 	Find(id int) (T, error)
 	List(field, value string) ([]T, error)
 	ListIndexFields(field string, value string) ([]*IndexEntry, error)
 	ListAllIndexFields(field string) ([]*IndexEntry, error)
+	// FindComposite looks up a single record by a composite/multi-field
+	// index's name, supplying one value per field in the order the index's
+	// Fields were declared.
+	FindComposite(indexName string, values ...string) (T, error)
+	// ListRange and ListAscendAfter read an IndexBTree-kind field in sorted
+	// order; both return nothing for a field that isn't a B-tree index.
+	ListRange(field, lo, hi string) ([]T, error)
+	ListAscendAfter(field, pivot string, limit int) ([]T, error)
+	// SearchIds, RangeIds and AllIds return matching IDs without hydrating
+	// the underlying records, so a caller composing several lookups (e.g.
+	// the query subpackage's And/Or) can intersect or union ID slices
+	// before ever reading an object file.
+	SearchIds(field string, values ...string) []int
+	RangeIds(field, lo, hi string) []int
+	AllIds() []int
+	// HasIndex and HasRangeIndex let a caller decide whether to read an
+	// index for a field or fall back to a full scan.
+	HasIndex(field string) bool
+	HasRangeIndex(field string) bool
+	// IsPartialIndex reports whether field's index (if any) is restricted by
+	// a Where predicate and therefore doesn't cover every record for that
+	// field.
+	IsPartialIndex(field string) bool
 	GetCount() int
 	PeekNextID() int
+	// Checkpoint durably rewrites the index files and truncates the WAL, so
+	// the next Init() has nothing left to replay.
+	Checkpoint() error
+	// Snapshot writes a consistent tarball of every object and index file,
+	// plus the replication LSN it was taken at, to w. It blocks concurrent
+	// Insert/Update/Delete for the duration of the walk so the tarball and
+	// the LSN it reports agree with each other.
+	Snapshot(w io.Writer) (lsn uint64, err error)
+	// StreamFrom writes every replicated operation after lsn, in order, to
+	// w. It returns a *replication.ErrGap if lsn is older than the oldest
+	// operation still retained, in which case the caller should fall back
+	// to Snapshot.
+	StreamFrom(lsn uint64, w io.Writer) error
+	// WaitForLSN blocks until this DB's own LastLSN has reached lsn, or ctx
+	// is done. It does not track any replica's progress.
+	WaitForLSN(ctx context.Context, lsn uint64) error
+	// LastLSN returns the LSN this DB's replication log assigned to its most
+	// recent Insert/Update/Delete/UpdateFunc/Upsert. ApplyReplicated does not
+	// advance it.
+	LastLSN() uint64
+	// ApplyReplicated writes a single operation received from a primary's
+	// replication stream. It is used by Replica, not by ordinary callers.
+	ApplyReplicated(op replication.Op, id int, data []byte) error
 	deleteDB() error
 }
 
 type fileDB[T FileEntity] struct {
 	path    string
 	indexes []FileIndexConfig
-	stat    FileStat
+	stat    FileStat[T]
 	index   FileIndex[T]
+	storage storage.Storage
+	wal     *wal.WAL
+	repl    *replication.Log
+	// idLocks serializes Update/Delete/UpdateFunc/Upsert for a given ID
+	// (hashed by id % len(idLocks)); Insert takes none, since its ID is only
+	// assigned under writeMu. This is so a read-modify-write on one record
+	// can't interleave with another write to the same record. It does not
+	// protect against a concurrent RebuildIndex/Checkpoint.
+	idLocks [idLockShards]sync.Mutex
+	// writeMu serializes the validate -> WAL append -> index apply sequence
+	// across Insert, Update, and the insert branch of Upsert, end to end.
+	// idLocks only keeps two writers to the *same* ID from interleaving;
+	// it does nothing for a unique-index collision between two *different*
+	// IDs (e.g. an Insert and an Update racing to claim the same unique
+	// value), since they hash to unrelated idLocks shards or, for Insert,
+	// no ID at all yet. Without writeMu, the early ValidateInsert/
+	// ValidateUpdate check in insertLocked/updateLocked could pass for both
+	// writers before either's WAL record lands; the loser's WAL record
+	// would already be durable by the time index.Insert/index.Update's own
+	// re-validation (under fileIndex's internal lock) caught the conflict
+	// and rejected it — so a write reported as failed to its caller would
+	// still be replayed as if it had succeeded after a crash. writeMu
+	// closes that window by making the whole sequence atomic.
+	writeMu sync.Mutex
+	// snapMu lets Snapshot exclude every writer for the length of its file
+	// walk (Lock), while normal writes only need to exclude Snapshot, not
+	// each other (RLock) — that's still handled by idLocks/wal/index.
+	snapMu sync.RWMutex
+	// lsnMu/lsnCond wake WaitForLSN callers every time repl.Append moves
+	// lastLSN forward.
+	lsnMu   sync.Mutex
+	lsnCond *sync.Cond
 }
 
-func NewFileDB[T FileEntity](path string, indexes []FileIndexConfig) FileDB[T] {
-	return &fileDB[T]{
+// NewFileDB builds a FileDB rooted at path. backend optionally overrides the
+// Storage every part of the DB (objects, indexes, stat, WAL, replication
+// log) reads and writes through; with none given it defaults to
+// storage.NewDiskStorage(), the backend a FileDB has always used.
+func NewFileDB[T FileEntity](path string, indexes []FileIndexConfig, backend ...storage.Storage) FileDB[T] {
+	s := storage.Storage(storage.NewDiskStorage())
+	if len(backend) > 0 {
+		s = backend[0]
+	}
+	db := &fileDB[T]{
 		path:    path,
 		indexes: indexes,
-		stat:    NewFileStat(path),
-		index:   NewFileIndex[T](path, indexes),
+		stat:    NewFileStat[T](path, s),
+		index:   NewFileIndex[T](path, indexes, s),
+		storage: s,
+		wal:     wal.NewWAL(path+"/_wal.log", s),
+		repl:    replication.NewLog(path+"/_repl.log", s),
 	}
+	db.lsnCond = sync.NewCond(&db.lsnMu)
+	return db
+}
+
+func (db *fileDB[T]) idLock(id int) *sync.Mutex {
+	idx := id % idLockShards
+	if idx < 0 {
+		idx += idLockShards
+	}
+	return &db.idLocks[idx]
 }
 
 func (db *fileDB[T]) Init() error {
-	if _, err := os.Stat(db.path); os.IsNotExist(err) {
-		if err = os.Mkdir(db.path, 0755); err != nil {
+	if !db.storage.Exists(db.path) {
+		if err := db.storage.Mkdir(db.path); err != nil {
 			return err
 		}
 	}
-	if err := db.stat.Init(); err != nil {
+
+	if err := db.index.Init(); err != nil {
 		return err
 	}
 
-	if err := db.index.Init(); err != nil {
+	records, err := db.wal.Init()
+	if err != nil {
 		return err
 	}
+	if len(records) > 0 {
+		for _, r := range records {
+			if err := db.replay(r); err != nil {
+				return err
+			}
+		}
+		// Object files may have been added/overwritten/removed by replay,
+		// so the indexes loaded above can be stale; rebuild them from the
+		// now-consistent object files before anything else reads them.
+		if err := db.index.RebuildAll(); err != nil {
+			return err
+		}
+	}
+
+	if err := db.stat.Init(db.index); err != nil {
+		return err
+	}
+	if len(records) > 0 {
+		// The stat file Init just loaded can predate the replay above (a
+		// crash between wal.Append and stat.AddCount is exactly the window
+		// Init's replay exists to close), so recompute count/nextID from
+		// the now-rebuilt index instead of trusting it.
+		if err := db.stat.Reconcile(db.index); err != nil {
+			return err
+		}
+	}
+
+	if err := db.repl.Init(); err != nil {
+		return err
+	}
+
+	if len(records) > 0 {
+		return db.Checkpoint()
+	}
 	return nil
 }
 
+// replay re-applies a WAL record left over from a crash between the WAL
+// append and the object file being durably written.
+func (db *fileDB[T]) replay(r *wal.Record) error {
+	path := db.GetObjectPath(r.ID)
+	if r.Op == wal.OpDelete {
+		if db.storage.Exists(path) {
+			return db.storage.Remove(path)
+		}
+		return nil
+	}
+	return db.writeObject(r.ID, r.Data)
+}
+
 func (db *fileDB[T]) Insert(e T) error {
-	e.SetID(db.stat.GetNextID(false))
-	if err := db.index.Insert(e); err != nil {
+	if err := db.insertLocked(e); err != nil {
 		return err
 	}
-	if err := db.stat.AddCount(1); err != nil {
+	db.checkpointIfNeeded()
+	return nil
+}
+
+func (db *fileDB[T]) insertLocked(e T) error {
+	db.snapMu.RLock()
+	defer db.snapMu.RUnlock()
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+	e.SetID(db.stat.GetNextID(false))
+	// Validate before the WAL record is written: an insert the caller is
+	// told failed must never become durable, or replay would resurrect it
+	// after a crash. See updateLocked for the analogous Update/Upsert case.
+	if err := db.index.ValidateInsert(e); err != nil {
 		return err
 	}
 	bytes, err := json.Marshal(e)
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(db.GetObjectPath(e.GetID()), bytes, 0644)
+	if err = db.wal.Append(&wal.Record{Op: wal.OpInsert, ID: e.GetID(), Data: bytes}); err != nil {
+		return err
+	}
+	if err = db.index.Insert(e); err != nil {
+		return err
+	}
+	if err = db.stat.AddCount(1); err != nil {
+		return err
+	}
+	if err = db.writeObject(e.GetID(), bytes); err != nil {
+		return err
+	}
+	return db.appendRepl(replication.OpInsert, e.GetID(), bytes)
 }
 
 func (db *fileDB[T]) Update(e T) error {
+	lock := db.idLock(e.GetID())
+	lock.Lock()
+	defer lock.Unlock()
 	prev, err := db.Find(e.GetID())
 	if err != nil {
 		return err
 	}
-	if err = db.index.Update(e, prev); err != nil {
+	if err := db.updateLocked(e, prev); err != nil {
+		return err
+	}
+	db.checkpointIfNeeded()
+	return nil
+}
+
+// updateLocked writes e over prev's old index entries and object file. The
+// caller must already hold db.idLock(e.GetID()).
+func (db *fileDB[T]) updateLocked(e, prev T) error {
+	db.snapMu.RLock()
+	defer db.snapMu.RUnlock()
+	// See writeMu's doc comment: without it, this pre-check could pass at
+	// the same time as a concurrent Insert/Update claiming the same unique
+	// value, and that race would only be caught after the WAL record below
+	// is already durable.
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+	// Validate before the WAL record is written: see Insert for why a
+	// rejected mutation must never become durable.
+	if err := db.index.ValidateUpdate(e, prev); err != nil {
 		return err
 	}
 	bytes, err := json.Marshal(e)
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(db.GetObjectPath(e.GetID()), bytes, 0644)
+	if err = db.wal.Append(&wal.Record{Op: wal.OpUpdate, ID: e.GetID(), Data: bytes}); err != nil {
+		return err
+	}
+	if err = db.index.Update(e, prev); err != nil {
+		return err
+	}
+	if err = db.writeObject(e.GetID(), bytes); err != nil {
+		return err
+	}
+	return db.appendRepl(replication.OpUpdate, e.GetID(), bytes)
 }
 
 func (db *fileDB[T]) Delete(id int) error {
+	lock := db.idLock(id)
+	lock.Lock()
+	defer lock.Unlock()
+	if err := db.deleteLocked(id); err != nil {
+		return err
+	}
+	db.checkpointIfNeeded()
+	return nil
+}
+
+// deleteLocked removes id's record and index entries. The caller must
+// already hold db.idLock(id).
+func (db *fileDB[T]) deleteLocked(id int) error {
+	db.snapMu.RLock()
+	defer db.snapMu.RUnlock()
 	prev, err := db.Find(id)
 	if err != nil {
 		return err
 	}
+	if err = db.wal.Append(&wal.Record{Op: wal.OpDelete, ID: id}); err != nil {
+		return err
+	}
 	if err = db.stat.AddCount(-1); err != nil {
 		return err
 	}
 	if err = db.index.Delete(prev); err != nil {
 		return err
 	}
-	return os.Remove(db.GetObjectPath(id))
+	if err = db.storage.Remove(db.GetObjectPath(id)); err != nil {
+		return err
+	}
+	return db.appendRepl(replication.OpDelete, id, nil)
+}
+
+// appendRepl records a mutation already durable on disk to the replication
+// log and wakes any WaitForLSN callers. It must be called under snapMu's
+// read lock so Snapshot can't observe a repl log entry whose object/index
+// write hasn't happened yet, or vice versa.
+func (db *fileDB[T]) appendRepl(op replication.Op, id int, data []byte) error {
+	if _, err := db.repl.Append(op, id, data); err != nil {
+		return err
+	}
+	db.lsnMu.Lock()
+	db.lsnCond.Broadcast()
+	db.lsnMu.Unlock()
+	return nil
+}
+
+// UpdateFunc loads the record at id, lets fn mutate a private copy of it,
+// and writes the result back, all while holding the same lock Update and
+// Delete use for that ID — so a concurrent call targeting the same ID
+// blocks instead of racing.
+func (db *fileDB[T]) UpdateFunc(id int, fn func(T) error) error {
+	lock := db.idLock(id)
+	lock.Lock()
+	defer lock.Unlock()
+	prev, err := db.Find(id)
+	if err != nil {
+		return err
+	}
+	e, err := cloneEntity(prev)
+	if err != nil {
+		return err
+	}
+	if err = fn(e); err != nil {
+		return err
+	}
+	if err := db.updateLocked(e, prev); err != nil {
+		return err
+	}
+	db.checkpointIfNeeded()
+	return nil
+}
+
+// Upsert loads the record at id if it exists, or a zero-valued record with
+// its ID already set otherwise, and lets fn decide the value to write back.
+// It holds the same per-ID lock as UpdateFunc, so a concurrent Upsert or
+// Update/Delete for the same ID can't interleave with it.
+func (db *fileDB[T]) Upsert(id int, fn func(e T, exists bool) (T, error)) error {
+	lock := db.idLock(id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	exists := db.storage.Exists(db.GetObjectPath(id))
+	var prev, input T
+	if exists {
+		var err error
+		prev, err = db.Find(id)
+		if err != nil {
+			return err
+		}
+		if input, err = cloneEntity(prev); err != nil {
+			return err
+		}
+	} else {
+		input = newEntity[T]()
+		input.SetID(id)
+	}
+
+	e, err := fn(input, exists)
+	if err != nil {
+		return err
+	}
+	e.SetID(id)
+
+	if exists {
+		if err := db.updateLocked(e, prev); err != nil {
+			return err
+		}
+	} else {
+		if err := db.upsertInsertLocked(id, e); err != nil {
+			return err
+		}
+	}
+	db.checkpointIfNeeded()
+	return nil
+}
+
+// upsertInsertLocked performs the insert half of Upsert, for an id that
+// doesn't exist yet. The caller must already hold db.idLock(id).
+func (db *fileDB[T]) upsertInsertLocked(id int, e T) error {
+	db.snapMu.RLock()
+	defer db.snapMu.RUnlock()
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+	// Validate before the WAL record is written: see Insert for why a
+	// rejected insert must never become durable. Re-checked here (rather
+	// than relying on the exists check above) because another Insert/Upsert
+	// could have taken id or e's unique field between then and now.
+	if err := db.index.ValidateInsert(e); err != nil {
+		return err
+	}
+	if db.storage.Exists(db.GetObjectPath(id)) {
+		return fmt.Errorf("upsert: id %d was inserted concurrently", id)
+	}
+	bytes, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if err = db.wal.Append(&wal.Record{Op: wal.OpInsert, ID: id, Data: bytes}); err != nil {
+		return err
+	}
+	if err = db.index.Insert(e); err != nil {
+		return err
+	}
+	if err = db.stat.AddCount(1); err != nil {
+		return err
+	}
+	// Upsert can insert a caller-chosen id rather than one minted by
+	// GetNextID, so nextID must be advanced past it here or the
+	// auto-increment counter could later reissue id to an Insert.
+	if err = db.stat.BumpNextID(id); err != nil {
+		return err
+	}
+	if err = db.writeObject(id, bytes); err != nil {
+		return err
+	}
+	return db.appendRepl(replication.OpInsert, id, bytes)
 }
 
 func (db *fileDB[T]) Find(id int) (T, error) {
-	return ReadObject[T](db.GetObjectPath(id))
+	return ReadObject[T](db.storage, db.GetObjectPath(id))
 }
 
 func (db *fileDB[T]) List(field, value string) ([]T, error) {
@@ -124,6 +505,83 @@ func (db *fileDB[T]) ListAllIndexFields(field string) ([]*IndexEntry, error) {
 	return db.index.SearchAllIndex(field), nil
 }
 
+func (db *fileDB[T]) FindComposite(indexName string, values ...string) (T, error) {
+	id := db.index.FindId(indexName, values...)
+	return db.Find(id)
+}
+
+func (db *fileDB[T]) ListRange(field, lo, hi string) ([]T, error) {
+	return db.hydrate(db.index.Range(field, lo, hi))
+}
+
+func (db *fileDB[T]) ListAscendAfter(field, pivot string, limit int) ([]T, error) {
+	es := make([]T, 0)
+	it := db.index.AscendAfter(field, pivot)
+	for entry := range it {
+		if limit > 0 && len(es) >= limit {
+			go func() {
+				for range it {
+				}
+			}()
+			break
+		}
+		e, err := db.Find(entry.ID)
+		if err != nil {
+			return nil, err
+		}
+		es = append(es, e)
+	}
+	return es, nil
+}
+
+func (db *fileDB[T]) SearchIds(field string, values ...string) []int {
+	return db.index.SearchId(field, values...)
+}
+
+func (db *fileDB[T]) RangeIds(field, lo, hi string) []int {
+	ids := make([]int, 0)
+	for entry := range db.index.Range(field, lo, hi) {
+		ids = append(ids, entry.ID)
+	}
+	return ids
+}
+
+func (db *fileDB[T]) AllIds() []int {
+	return db.index.ListAllIds()
+}
+
+func (db *fileDB[T]) HasIndex(field string) bool {
+	return db.index.GetIndexConfig(field) != nil
+}
+
+func (db *fileDB[T]) HasRangeIndex(field string) bool {
+	ic := db.index.GetIndexConfig(field)
+	return ic != nil && ic.Kind == IndexBTree
+}
+
+// IsPartialIndex reports whether field's index, if any, was declared with a
+// Where predicate, so it only covers a subset of records for that field. A
+// caller that needs every matching record (e.g. the query subpackage's
+// Eq/Range, which must not silently drop records outside the predicate)
+// should fall back to a full scan for such a field instead of trusting
+// HasIndex/HasRangeIndex as meaning "complete".
+func (db *fileDB[T]) IsPartialIndex(field string) bool {
+	ic := db.index.GetIndexConfig(field)
+	return ic != nil && ic.Where != nil
+}
+
+func (db *fileDB[T]) hydrate(it BTreeIterator[T]) ([]T, error) {
+	es := make([]T, 0)
+	for entry := range it {
+		e, err := db.Find(entry.ID)
+		if err != nil {
+			return nil, err
+		}
+		es = append(es, e)
+	}
+	return es, nil
+}
+
 func (db *fileDB[T]) GetCount() int {
 	return db.stat.GetCount()
 }
@@ -132,14 +590,200 @@ func (db *fileDB[T]) PeekNextID() int {
 	return db.stat.GetNextID(true)
 }
 
+// Checkpoint takes snapMu exclusively, the same as Snapshot, so it can't
+// race Insert/Update/Delete appending to or reading db.wal.file while this
+// closes and reassigns it.
+func (db *fileDB[T]) Checkpoint() error {
+	db.snapMu.Lock()
+	defer db.snapMu.Unlock()
+	return db.checkpointLocked()
+}
+
+// checkpointLocked does the actual work of Checkpoint. The caller must
+// already hold snapMu exclusively.
+func (db *fileDB[T]) checkpointLocked() error {
+	if err := db.index.Checkpoint(); err != nil {
+		return err
+	}
+	return db.wal.Checkpoint()
+}
+
+// checkpointIfNeeded runs an automatic checkpoint once the WAL has grown
+// past checkpointOpThreshold since the last one. It must be called after
+// the caller's own write (and the snapMu/writeMu locks that guarded it)
+// have already been released, since it needs snapMu exclusively itself.
+// Errors are intentionally swallowed: an automatic checkpoint is an
+// optimization, and the caller's own write already succeeded and is
+// durable regardless of whether this one does.
+func (db *fileDB[T]) checkpointIfNeeded() {
+	if db.wal.OpsSinceCheckpoint() < checkpointOpThreshold {
+		return
+	}
+	db.snapMu.Lock()
+	defer db.snapMu.Unlock()
+	db.checkpointLocked()
+}
+
+// Snapshot checkpoints the index files, then walks the object and index
+// files under db.path into a tar stream written to w, tagged with the LSN
+// they're consistent as of. It holds snapMu for the duration, so Insert/
+// Update/Delete/UpdateFunc/Upsert block until the walk finishes — that's
+// what keeps the tarball and the reported LSN from describing two
+// different points in time.
+func (db *fileDB[T]) Snapshot(w io.Writer) (uint64, error) {
+	db.snapMu.Lock()
+	defer db.snapMu.Unlock()
+	if err := db.index.Checkpoint(); err != nil {
+		return 0, err
+	}
+	lsn := db.repl.LastLSN()
+	if err := replication.WriteSnapshot(w, db.storage, db.path, lsn); err != nil {
+		return 0, err
+	}
+	return lsn, nil
+}
+
+func (db *fileDB[T]) StreamFrom(lsn uint64, w io.Writer) error {
+	return db.repl.StreamFrom(lsn, w)
+}
+
+// WaitForLSN blocks until LastLSN has reached lsn or ctx is done, waking on
+// each local write instead of polling. Writes applied through
+// ApplyReplicated do not move LastLSN, so on a Replica's DB this does not
+// follow what the replica has applied.
+func (db *fileDB[T]) WaitForLSN(ctx context.Context, lsn uint64) error {
+	done := make(chan struct{})
+	go func() {
+		db.lsnMu.Lock()
+		// Re-checking ctx.Err() here, not just LastLSN, is what lets this
+		// goroutine actually exit on cancellation: Broadcast only wakes
+		// Wait(), it doesn't change the loop condition. Without it, a ctx
+		// that's cancelled but never reaches lsn would wake this goroutine
+		// once and then leave it right back in Wait() forever.
+		for db.repl.LastLSN() < lsn && ctx.Err() == nil {
+			db.lsnCond.Wait()
+		}
+		db.lsnMu.Unlock()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return ctx.Err()
+	case <-ctx.Done():
+		// Wake the waiting goroutine so its loop re-checks ctx.Err() and
+		// exits; then wait for it to actually do so, so no goroutine is
+		// left running past this call's return.
+		db.lsnMu.Lock()
+		db.lsnCond.Broadcast()
+		db.lsnMu.Unlock()
+		<-done
+		return ctx.Err()
+	}
+}
+
+func (db *fileDB[T]) LastLSN() uint64 {
+	return db.repl.LastLSN()
+}
+
+// ApplyReplicated writes a single operation received from a primary's
+// replication stream directly to this DB's object file and index, bypassing
+// the WAL and stat ID allocation Insert/Update/Delete use — the record
+// already carries the ID and payload the primary assigned, so there's
+// nothing left to decide locally. It's used by Replica, not by ordinary
+// callers.
+func (db *fileDB[T]) ApplyReplicated(op replication.Op, id int, data []byte) error {
+	lock := db.idLock(id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if op == replication.OpDelete {
+		prev, err := db.Find(id)
+		if err != nil {
+			return err
+		}
+		if err := db.index.Delete(prev); err != nil {
+			return err
+		}
+		if err := db.stat.AddCount(-1); err != nil {
+			return err
+		}
+		return db.storage.Remove(db.GetObjectPath(id))
+	}
+
+	e := newEntity[T]()
+	if err := json.Unmarshal(data, e); err != nil {
+		return err
+	}
+	prev, err := db.Find(id)
+	if err == nil {
+		return db.replicateUpdate(e, prev, data)
+	}
+	if err := db.index.Insert(e); err != nil {
+		return err
+	}
+	if err := db.stat.AddCount(1); err != nil {
+		return err
+	}
+	return db.writeObject(id, data)
+}
+
+func (db *fileDB[T]) replicateUpdate(e, prev T, data []byte) error {
+	if err := db.index.Update(e, prev); err != nil {
+		return err
+	}
+	return db.writeObject(e.GetID(), data)
+}
+
+func (db *fileDB[T]) writeObject(id int, bytes []byte) error {
+	file, err := db.storage.Create(db.GetObjectPath(id))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(bytes)
+	return err
+}
+
 //lint:ignore U1000 Ignore unused function temporarily for testing
 func (db *fileDB[T]) deleteDB() error {
-	return os.RemoveAll(db.path)
+	return db.storage.RemoveAll(db.path)
+}
+
+// newEntity constructs a zero-valued T, e.g. a fresh *TestEntity for
+// FileDB[*TestEntity], via reflection since T's constructor isn't known
+// generically.
+func newEntity[T FileEntity]() T {
+	return reflect.New(reflect.TypeOf(new(T)).Elem().Elem()).Interface().(T)
+}
+
+// cloneEntity returns an independent copy of e via a JSON round-trip, the
+// same encoding used to persist entities, so callers can mutate the copy
+// without affecting e.
+func cloneEntity[T FileEntity](e T) (T, error) {
+	bytes, err := json.Marshal(e)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	clone := newEntity[T]()
+	if err = json.Unmarshal(bytes, clone); err != nil {
+		var zero T
+		return zero, err
+	}
+	return clone, nil
 }
 
-func ReadObject[T FileEntity](path string) (T, error) {
-	e := reflect.New(reflect.TypeOf(new(T)).Elem().Elem()).Interface().(T)
-	bytes, err := os.ReadFile(filepath.FromSlash(path))
+// ReadObject reads and decodes the entity file at path through s, the same
+// Storage a FileDB was constructed with, so a non-disk backend (e.g.
+// storage.MemStorage) can actually back reads and not just writes.
+func ReadObject[T FileEntity](s storage.Storage, path string) (T, error) {
+	e := newEntity[T]()
+	file, err := s.Open(path, os.O_RDONLY, 0644)
+	if err != nil {
+		return e, err
+	}
+	defer file.Close()
+	bytes, err := io.ReadAll(file)
 	if err != nil {
 		return e, err
 	}
@@ -155,16 +799,13 @@ func (db *fileDB[T]) GetObjectPath(id int) string {
 	for i > 0 {
 		if i%10 > 0 {
 			nums = append(nums, strconv.Itoa(i%10))
-			CreateDir(filepath.FromSlash(db.path + "/" + strings.Join(nums, "/")))
+			db.storage.Mkdir(db.path + "/" + strings.Join(nums, "/"))
 		}
 		i /= 10
 	}
-	return filepath.FromSlash(db.path + "/" + strings.Join(nums, "/") + strconv.Itoa(id) + ".dat")
+	return db.path + "/" + strings.Join(nums, "/") + strconv.Itoa(id) + ".dat"
 }
 
 func CreateDir(path string) error {
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		return os.Mkdir(path, 0755)
-	}
-	return nil
+	return storage.NewDiskStorage().Mkdir(path)
 }
@@ -1,14 +1,29 @@
 package filedb
 
 import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
+
+	"github.com/dannyswat/filedb/storage"
+	"github.com/dannyswat/filedb/wal"
 )
 
+var errTestRejected = errors.New("rejected")
+
 type TestEntity struct {
-	ID   int
-	Name string
-	Age  int
+	ID     int
+	Name   string
+	Age    int
+	Status string
+	City   string
 }
 
 func NewTestEntity(name string, age int) *TestEntity {
@@ -32,6 +47,10 @@ func (te *TestEntity) GetValue(field string) string {
 		return te.Name
 	case "Age":
 		return strconv.Itoa(te.Age)
+	case "Status":
+		return te.Status
+	case "City":
+		return te.City
 	}
 	return ""
 }
@@ -102,6 +121,796 @@ func TestFileDB(t *testing.T) {
 	}
 }
 
+func TestUpdateFuncAndUpsert(t *testing.T) {
+	db := NewFileDB[*TestEntity]("test", []FileIndexConfig{
+		{Unique: true, Field: "Name"},
+		{Unique: false, Field: "Age"},
+	})
+	if err := db.Init(); err != nil {
+		t.Error(err)
+	}
+
+	if err := db.Insert(NewTestEntity("Alice", 20)); err != nil {
+		t.Error(err)
+	}
+	id := db.PeekNextID() - 1
+
+	if err := db.UpdateFunc(id, func(e *TestEntity) error {
+		e.Age = 21
+		return nil
+	}); err != nil {
+		t.Error(err)
+	}
+	e, err := db.Find(id)
+	if err != nil {
+		t.Error(err)
+	}
+	if e.Age != 21 {
+		t.Error("UpdateFunc failed")
+	}
+
+	if err := db.UpdateFunc(id, func(e *TestEntity) error {
+		return errTestRejected
+	}); err != errTestRejected {
+		t.Error("UpdateFunc should propagate fn error without writing")
+	}
+	if e, err = db.Find(id); err != nil || e.Age != 21 {
+		t.Error("UpdateFunc should not have modified the record on error")
+	}
+
+	newID := db.PeekNextID()
+	if err := db.Upsert(newID, func(e *TestEntity, exists bool) (*TestEntity, error) {
+		if exists {
+			t.Error("expected Upsert to report exists=false for a new id")
+		}
+		e.Name = "Carol"
+		e.Age = 40
+		return e, nil
+	}); err != nil {
+		t.Error(err)
+	}
+	if e, err = db.Find(newID); err != nil || e.Name != "Carol" {
+		t.Error("Upsert failed to insert")
+	}
+	if db.GetCount() != 2 {
+		t.Error("Upsert should have incremented the record count")
+	}
+	if db.PeekNextID() != newID+1 {
+		t.Errorf("PeekNextID() after Upsert(%d, ...) = %d, want %d: nextID must advance past an inserted id or Insert could reuse it", newID, db.PeekNextID(), newID+1)
+	}
+
+	if err := db.Upsert(newID, func(e *TestEntity, exists bool) (*TestEntity, error) {
+		if !exists {
+			t.Error("expected Upsert to report exists=true for an existing id")
+		}
+		e.Age = 41
+		return e, nil
+	}); err != nil {
+		t.Error(err)
+	}
+	if e, err = db.Find(newID); err != nil || e.Age != 41 {
+		t.Error("Upsert failed to update")
+	}
+	if db.GetCount() != 2 {
+		t.Error("Upsert update should not change the record count")
+	}
+
+	if err := db.Delete(id); err != nil {
+		t.Error(err)
+	}
+	if err := db.Delete(newID); err != nil {
+		t.Error(err)
+	}
+	if err := db.deleteDB(); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestRejectedInsertDoesNotSurviveRestart is the regression for a bug where a
+// WAL record was appended before the unique-index check ran: a rejected
+// Insert still left a record in the log, and since nothing checkpoints the
+// WAL until the next Init, a fresh Init replayed it and resurrected the
+// rejected row.
+func TestRejectedInsertDoesNotSurviveRestart(t *testing.T) {
+	db := NewFileDB[*TestEntity]("test_wal_validation", []FileIndexConfig{
+		{Unique: true, Field: "Name"},
+	})
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Insert(NewTestEntity("Alice", 20)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Insert(NewTestEntity("Alice", 21)); err == nil {
+		t.Fatal("expected unique index violation for duplicate Name")
+	}
+	if db.GetCount() != 1 {
+		t.Fatalf("GetCount before restart = %d, want 1", db.GetCount())
+	}
+
+	db2 := NewFileDB[*TestEntity]("test_wal_validation", []FileIndexConfig{
+		{Unique: true, Field: "Name"},
+	})
+	if err := db2.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if db2.GetCount() != 1 {
+		t.Fatalf("GetCount after restart = %d, want 1 (rejected insert should not be replayed)", db2.GetCount())
+	}
+	ids := db2.SearchIds("Name", "Alice")
+	if len(ids) != 1 {
+		t.Fatalf("SearchIds(Name, Alice) after restart = %v, want exactly one match", ids)
+	}
+
+	if err := db2.deleteDB(); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestGetCountReconciledAfterWALReplay reproduces a crash between
+// wal.Append and stat.AddCount: a third record's WAL entry survives with no
+// matching update to _stat.dat. GetCount() after the restart that replays
+// it must reflect all three records, not the stale count Init would
+// otherwise load straight from disk.
+func TestGetCountReconciledAfterWALReplay(t *testing.T) {
+	path := "test_stat_reconcile"
+	db := NewFileDB[*TestEntity](path, []FileIndexConfig{
+		{Unique: true, Field: "Name"},
+	})
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Insert(NewTestEntity("Alice", 20)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Insert(NewTestEntity("Bob", 30)); err != nil {
+		t.Fatal(err)
+	}
+	if db.GetCount() != 2 {
+		t.Fatalf("GetCount before the injected crash = %d, want 2", db.GetCount())
+	}
+
+	// Simulate the crash window: a third insert's WAL record lands, but the
+	// process dies before stat.AddCount (or the object write) ever run.
+	third := &TestEntity{ID: 3, Name: "Carol", Age: 40}
+	data, err := json.Marshal(third)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := wal.NewWAL(path+"/_wal.log", storage.NewDiskStorage())
+	if _, err := w.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Append(&wal.Record{Op: wal.OpInsert, ID: 3, Data: data}); err != nil {
+		t.Fatal(err)
+	}
+
+	db2 := NewFileDB[*TestEntity](path, []FileIndexConfig{
+		{Unique: true, Field: "Name"},
+	})
+	if err := db2.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if db2.GetCount() != 3 {
+		t.Fatalf("GetCount after replaying the injected insert = %d, want 3", db2.GetCount())
+	}
+	if db2.PeekNextID() != 4 {
+		t.Fatalf("PeekNextID after replaying the injected insert = %d, want 4", db2.PeekNextID())
+	}
+	ids := db2.SearchIds("Name", "Carol")
+	if len(ids) != 1 || ids[0] != 3 {
+		t.Fatalf("SearchIds(Name, Carol) = %v, want [3]", ids)
+	}
+
+	if err := db2.deleteDB(); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestAutoCheckpointBoundsWALGrowth reproduces what an unbounded WAL would
+// cost a clean restart: without an automatic Checkpoint, a long-running
+// process would leave every record it ever wrote in the log for the next
+// Init to replay. Past checkpointOpThreshold ops, Insert should have
+// triggered one on its own, so the log never accumulates that many records.
+func TestAutoCheckpointBoundsWALGrowth(t *testing.T) {
+	path := "test_auto_checkpoint"
+	db := NewFileDB[*TestEntity](path, []FileIndexConfig{
+		{Unique: true, Field: "Name"},
+	})
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	const n = checkpointOpThreshold + 10
+	for i := 0; i < n; i++ {
+		if err := db.Insert(NewTestEntity(fmt.Sprintf("user-%d", i), i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := wal.NewWAL(path+"/_wal.log", storage.NewDiskStorage())
+	records, err := w.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) >= checkpointOpThreshold {
+		t.Fatalf("WAL has %d records after %d inserts, want an automatic checkpoint to have truncated it well below %d", len(records), n, checkpointOpThreshold)
+	}
+	if db.GetCount() != n {
+		t.Fatalf("GetCount() = %d, want %d: an automatic checkpoint must not lose or duplicate records", db.GetCount(), n)
+	}
+
+	if err := db.deleteDB(); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestConcurrentInsertUpdateDelete is the concurrent counterpart to
+// TestUpdateFuncAndUpsert: run with -race, it catches fileStat.nextID and
+// fileIndex.indexes/btrees being shared mutable state that idLocks (keyed
+// on an already-assigned ID) can't protect Insert with, and that different
+// IDs hashing to different shards don't protect at all.
+func TestConcurrentInsertUpdateDelete(t *testing.T) {
+	const n = 50
+	db := NewFileDB[*TestEntity]("test_concurrency", []FileIndexConfig{
+		{Unique: true, Field: "Name"},
+		{Unique: false, Field: "Age"},
+	})
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = db.Insert(NewTestEntity(fmt.Sprintf("concurrent-%d", i), i))
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("concurrent Insert %d failed: %v", i, err)
+		}
+	}
+	if db.GetCount() != n {
+		t.Fatalf("GetCount after %d concurrent inserts = %d", n, db.GetCount())
+	}
+	ids := db.AllIds()
+	seen := make(map[int]bool, n)
+	for _, id := range ids {
+		if seen[id] {
+			t.Fatalf("duplicate ID %d assigned by concurrent Insert", id)
+		}
+		seen[id] = true
+	}
+	if len(ids) != n {
+		t.Fatalf("AllIds returned %d IDs, want %d", len(ids), n)
+	}
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i, id int) {
+			defer wg.Done()
+			errs[i] = db.UpdateFunc(id, func(e *TestEntity) error {
+				e.Age = e.Age + 1000
+				return nil
+			})
+		}(i, ids[i])
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("concurrent UpdateFunc %d failed: %v", i, err)
+		}
+	}
+	for _, id := range ids {
+		e, err := db.Find(id)
+		if err != nil {
+			t.Fatalf("Find(%d) after concurrent UpdateFunc: %v", id, err)
+		}
+		if e.Age < 1000 {
+			t.Fatalf("record %d Age = %d, want an UpdateFunc'd value", id, e.Age)
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i, id int) {
+			defer wg.Done()
+			errs[i] = db.Delete(id)
+		}(i, ids[i])
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("concurrent Delete %d failed: %v", i, err)
+		}
+	}
+	if db.GetCount() != 0 {
+		t.Fatalf("GetCount after concurrent Delete = %d, want 0", db.GetCount())
+	}
+
+	if err := db.deleteDB(); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestConcurrentUniqueInsertRaceNoPhantomWAL races concurrent Inserts all
+// claiming the same unique Name against each other. Before writeMu, each
+// Insert's early ValidateInsert could pass for more than one racer before
+// any of their WAL records landed, so a losing Insert's WAL record could
+// still be durable by the time index.Insert's own re-check rejected it —
+// and would be replayed as if it had succeeded on the next restart. Run
+// with -race.
+func TestConcurrentUniqueInsertRaceNoPhantomWAL(t *testing.T) {
+	const n = 20
+	path := "test_writemu_race"
+	db := NewFileDB[*TestEntity](path, []FileIndexConfig{
+		{Unique: true, Field: "Name"},
+	})
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var successCount int32
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := db.Insert(NewTestEntity("Racer", i)); err == nil {
+				atomic.AddInt32(&successCount, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if successCount != 1 {
+		t.Fatalf("successCount = %d, want exactly 1 winner of the unique-name race", successCount)
+	}
+	if db.GetCount() != 1 {
+		t.Fatalf("GetCount() = %d, want 1", db.GetCount())
+	}
+
+	// Restart from the same path: if a losing Insert's WAL record had
+	// survived, replay would resurrect a second "Racer" record here.
+	db2 := NewFileDB[*TestEntity](path, []FileIndexConfig{
+		{Unique: true, Field: "Name"},
+	})
+	if err := db2.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if db2.GetCount() != 1 {
+		t.Fatalf("GetCount() after restart = %d, want 1: a losing Insert's WAL record must not have been replayed", db2.GetCount())
+	}
+
+	if err := db2.deleteDB(); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestConcurrentCheckpointDuringInsert races an explicit Checkpoint call
+// against concurrent Insert/Update/Delete. Checkpoint used to close and
+// reassign wal.file without taking snapMu, while writers only held
+// snapMu.RLock — a data race on wal.file that could write to an
+// already-closed file or drop an in-flight record. Run with -race.
+func TestConcurrentCheckpointDuringInsert(t *testing.T) {
+	const n = 50
+	db := NewFileDB[*TestEntity]("test_checkpoint_race", []FileIndexConfig{
+		{Unique: true, Field: "Name"},
+	})
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = db.Insert(NewTestEntity(fmt.Sprintf("checkpoint-race-%d", i), i))
+		}(i)
+	}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := db.Checkpoint(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("concurrent Insert %d failed: %v", i, err)
+		}
+	}
+	if db.GetCount() != n {
+		t.Fatalf("GetCount after %d concurrent inserts racing Checkpoint = %d", n, db.GetCount())
+	}
+
+	if err := db.deleteDB(); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestConcurrentBTreeRangeDuringInsert is the regression for a data race
+// between an in-flight ListRange iterator and a concurrent Insert into the
+// same IndexBTree field: BTreeIndex used to have no locking of its own, so
+// a reader walking the tree in its emit goroutine could race a writer's
+// ReplaceOrInsert. Run with -race.
+func TestConcurrentBTreeRangeDuringInsert(t *testing.T) {
+	const n = 50
+	db := NewFileDB[*TestEntity]("test_btree_concurrent", []FileIndexConfig{
+		{Field: "Age", Kind: IndexBTree},
+	})
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// A concurrent Insert's index entry can land before its object
+			// file is durably written, so ListRange racing it may transiently
+			// fail to hydrate a record that's still mid-insert; that's
+			// expected here, not a bug, so errors are ignored. What this
+			// test actually checks is the absence of a data race (run with
+			// -race) and, once every Insert has finished, a consistent
+			// final count below.
+			db.ListRange("Age", "0", "1000")
+		}()
+	}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := db.Insert(NewTestEntity(fmt.Sprintf("range-%d", i), i)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if db.GetCount() != n {
+		t.Fatalf("GetCount after %d concurrent inserts = %d", n, db.GetCount())
+	}
+	if err := db.deleteDB(); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestCompositeIndexLookup covers a composite/multi-field index end to end:
+// insert, FindComposite/SearchId by the full Fields tuple, and an Update
+// that changes one of the fields.
+func TestCompositeIndexLookup(t *testing.T) {
+	db := NewFileDB[*TestEntity]("test_composite", []FileIndexConfig{
+		{Unique: true, Fields: []string{"Status", "City"}},
+	})
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	e1 := &TestEntity{Name: "Alice", Status: "active", City: "NYC"}
+	if err := db.Insert(e1); err != nil {
+		t.Fatal(err)
+	}
+	e2 := &TestEntity{Name: "Bob", Status: "active", City: "LA"}
+	if err := db.Insert(e2); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := db.FindComposite("Status+City", "active", "NYC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Name != "Alice" {
+		t.Fatalf("FindComposite(active, NYC) = %q, want Alice", found.Name)
+	}
+	ids := db.SearchIds("Status+City", "active", "LA")
+	if len(ids) != 1 || ids[0] != e2.GetID() {
+		t.Fatalf("SearchIds(active, LA) = %v, want [%d]", ids, e2.GetID())
+	}
+
+	// A second record with the same (Status, City) tuple must violate the
+	// unique composite index.
+	if err := db.Insert(&TestEntity{Name: "Carol", Status: "active", City: "NYC"}); err == nil {
+		t.Fatal("expected unique composite index violation for duplicate (Status, City)")
+	}
+
+	// Changing City moves the record to a new composite key.
+	e1.City = "SF"
+	if err := db.Update(e1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.FindComposite("Status+City", "active", "NYC"); err == nil {
+		t.Fatal("expected no record left at the old (active, NYC) key after Update")
+	}
+	found, err = db.FindComposite("Status+City", "active", "SF")
+	if err != nil || found.Name != "Alice" {
+		t.Fatalf("FindComposite(active, SF) after Update = %+v, %v, want Alice", found, err)
+	}
+
+	if err := db.deleteDB(); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestPartialIndexWhere covers an index restricted by a Where predicate:
+// only matching records should appear in it, and a record must be added or
+// dropped as it transitions in or out of the predicate on Update.
+func TestPartialIndexWhere(t *testing.T) {
+	db := NewFileDB[*TestEntity]("test_partial", []FileIndexConfig{
+		{Field: "City", Where: func(e FileEntity) bool {
+			return e.GetValue("Status") == "active"
+		}},
+	})
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	active := &TestEntity{Name: "Alice", Status: "active", City: "NYC"}
+	if err := db.Insert(active); err != nil {
+		t.Fatal(err)
+	}
+	inactive := &TestEntity{Name: "Bob", Status: "inactive", City: "NYC"}
+	if err := db.Insert(inactive); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := db.SearchIds("City", "NYC")
+	if len(ids) != 1 || ids[0] != active.GetID() {
+		t.Fatalf("SearchIds(City, NYC) = %v, want only the active record [%d]", ids, active.GetID())
+	}
+
+	// Transition out: no longer active, must drop out of the index.
+	active.Status = "inactive"
+	if err := db.Update(active); err != nil {
+		t.Fatal(err)
+	}
+	if ids := db.SearchIds("City", "NYC"); len(ids) != 0 {
+		t.Fatalf("SearchIds(City, NYC) after leaving Where = %v, want none", ids)
+	}
+
+	// Transition in: becomes active, must appear in the index.
+	inactive.Status = "active"
+	if err := db.Update(inactive); err != nil {
+		t.Fatal(err)
+	}
+	if ids := db.SearchIds("City", "NYC"); len(ids) != 1 || ids[0] != inactive.GetID() {
+		t.Fatalf("SearchIds(City, NYC) after entering Where = %v, want only [%d]", ids, inactive.GetID())
+	}
+
+	if err := db.deleteDB(); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestAllIdsIndependentOfPartialIndex proves AllIds (and so query.Not and a
+// full scan, which read it) still sees every record when the only configured index is partial: Bob
+// never satisfies the Where and so never appears in the "City" index, but
+// he must still be part of the complete record universe.
+func TestAllIdsIndependentOfPartialIndex(t *testing.T) {
+	db := NewFileDB[*TestEntity]("test_allids_partial", []FileIndexConfig{
+		{Field: "City", Where: func(e FileEntity) bool {
+			return e.GetValue("Status") == "active"
+		}},
+	})
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	active := &TestEntity{Name: "Alice", Status: "active", City: "NYC"}
+	if err := db.Insert(active); err != nil {
+		t.Fatal(err)
+	}
+	inactive := &TestEntity{Name: "Bob", Status: "inactive", City: "NYC"}
+	if err := db.Insert(inactive); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := db.AllIds()
+	if len(ids) != 2 {
+		t.Fatalf("AllIds() = %v, want both records even though only one satisfies the partial index's Where", ids)
+	}
+	if db.GetCount() != 2 {
+		t.Fatalf("GetCount() = %d, want 2", db.GetCount())
+	}
+
+	if err := db.deleteDB(); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestUniquePartialIndexTransitionIn proves a record transitioning into a
+// unique partial index's Where is checked for collisions even when its key
+// value is unchanged: an inactive record sharing a key with an already-active
+// one must be refused when it turns active, not silently double-indexed.
+func TestUniquePartialIndexTransitionIn(t *testing.T) {
+	db := NewFileDB[*TestEntity]("test_unique_partial_transition", []FileIndexConfig{
+		{Field: "City", Unique: true, Where: func(e FileEntity) bool {
+			return e.GetValue("Status") == "active"
+		}},
+	})
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	active := &TestEntity{Name: "Alice", Status: "active", City: "NYC"}
+	if err := db.Insert(active); err != nil {
+		t.Fatal(err)
+	}
+	inactive := &TestEntity{Name: "Bob", Status: "inactive", City: "NYC"}
+	if err := db.Insert(inactive); err != nil {
+		t.Fatal(err)
+	}
+
+	inactive.Status = "active"
+	if err := db.Update(inactive); err == nil {
+		t.Fatal("Update(inactive -> active) = nil, want unique index violation")
+	}
+	if ids := db.SearchIds("City", "NYC"); len(ids) != 1 || ids[0] != active.GetID() {
+		t.Fatalf("SearchIds(City, NYC) after rejected Update = %v, want only the original active record [%d]", ids, active.GetID())
+	}
+
+	if err := db.deleteDB(); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestCompositeKeyEscaping proves a composite key can't be fooled by a
+// literal tab in one of its fields: without escaping, ("x\t", "y") and
+// ("x", "\ty") would join to the identical string "x\t\ty" and collide.
+func TestCompositeKeyEscaping(t *testing.T) {
+	db := NewFileDB[*TestEntity]("test_escaping", []FileIndexConfig{
+		{Fields: []string{"Name", "City"}},
+	})
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	e1 := &TestEntity{Name: "x\t", City: "y"}
+	if err := db.Insert(e1); err != nil {
+		t.Fatal(err)
+	}
+	e2 := &TestEntity{Name: "x", City: "\ty"}
+	if err := db.Insert(e2); err != nil {
+		t.Fatal(err)
+	}
+
+	ids1 := db.SearchIds("Name+City", "x\t", "y")
+	if len(ids1) != 1 || ids1[0] != e1.GetID() {
+		t.Fatalf(`SearchIds("x\t", "y") = %v, want only [%d]`, ids1, e1.GetID())
+	}
+	ids2 := db.SearchIds("Name+City", "x", "\ty")
+	if len(ids2) != 1 || ids2[0] != e2.GetID() {
+		t.Fatalf(`SearchIds("x", "\ty") = %v, want only [%d]`, ids2, e2.GetID())
+	}
+
+	// A value containing a literal newline and backslash must also survive
+	// the round trip intact.
+	e3 := &TestEntity{Name: "line1\nline2\\end", City: "z"}
+	if err := db.Insert(e3); err != nil {
+		t.Fatal(err)
+	}
+	ids3 := db.SearchIds("Name+City", "line1\nline2\\end", "z")
+	if len(ids3) != 1 || ids3[0] != e3.GetID() {
+		t.Fatalf("SearchIds with newline/backslash value = %v, want only [%d]", ids3, e3.GetID())
+	}
+
+	if err := db.deleteDB(); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestBTreeNumericLess proves an IndexBTree config actually orders by its
+// Less func rather than falling back to lexicographic string order: 9, 10
+// and 100 sort adjacently in ascending numeric order but not in string
+// order ("10" < "100" < "9" lexicographically).
+func TestBTreeNumericLess(t *testing.T) {
+	db := NewFileDB[*TestEntity]("test_btree_less", []FileIndexConfig{
+		{Field: "Age", Kind: IndexBTree, Less: func(a, b string) bool {
+			ai, _ := strconv.Atoi(a)
+			bi, _ := strconv.Atoi(b)
+			return ai < bi
+		}},
+	})
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for _, age := range []int{100, 9, 10} {
+		if err := db.Insert(NewTestEntity(fmt.Sprintf("age-%d", age), age)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	all, err := db.ListRange("Age", "0", "1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotAges := make([]int, len(all))
+	for i, e := range all {
+		gotAges[i] = e.Age
+	}
+	wantAges := []int{9, 10, 100}
+	if len(gotAges) != len(wantAges) {
+		t.Fatalf("ListRange(Age, 0, 1000) = %v, want %v", gotAges, wantAges)
+	}
+	for i := range wantAges {
+		if gotAges[i] != wantAges[i] {
+			t.Fatalf("ListRange(Age, 0, 1000) = %v, want ascending numeric order %v", gotAges, wantAges)
+		}
+	}
+
+	if err := db.deleteDB(); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestBTreeIndexFileSortedOnDisk proves a B-tree index's on-disk file is
+// written with keys in ascending order (not map iteration order), so a
+// future bulk-load into google/btree can stream it straight in without
+// re-sorting first.
+func TestBTreeIndexFileSortedOnDisk(t *testing.T) {
+	less := func(a, b string) bool {
+		ai, _ := strconv.Atoi(a)
+		bi, _ := strconv.Atoi(b)
+		return ai < bi
+	}
+	db := NewFileDB[*TestEntity]("test_btree_sorted_file", []FileIndexConfig{
+		{Field: "Age", Kind: IndexBTree, Less: less},
+	})
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for _, age := range []int{50, 5, 100, 1, 9} {
+		if err := db.Insert(NewTestEntity(fmt.Sprintf("age-%d", age), age)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open("test_btree_sorted_file/_Age.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+	codec := TabIndexCodec{}
+	var keys []string
+	for {
+		key, _, err := codec.DecodeEntry(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) != 5 {
+		t.Fatalf("read %d keys from index file, want 5", len(keys))
+	}
+	for i := 1; i < len(keys); i++ {
+		if less(keys[i], keys[i-1]) {
+			t.Fatalf("index file keys = %v, want ascending order", keys)
+		}
+	}
+
+	if err := db.deleteDB(); err != nil {
+		t.Error(err)
+	}
+}
+
 func TestFileIndexInclude(t *testing.T) {
 	db := NewFileDB[*TestEntity]("test", []FileIndexConfig{
 		{Unique: true, Field: "Name"},
@@ -193,3 +1002,36 @@ func TestFileIndexInclude(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+// TestFileDBWithMemStorage proves NewFileDB's storage backend is actually
+// injectable: every read and write (object, index, stat, WAL) goes through
+// the MemStorage passed in rather than falling back to disk.
+func TestFileDBWithMemStorage(t *testing.T) {
+	mem := storage.NewMemStorage()
+	db := NewFileDB[*TestEntity]("memtest", []FileIndexConfig{
+		{Unique: true, Field: "Name"},
+	}, mem)
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	e := NewTestEntity("Alice", 20)
+	if err := db.Insert(e); err != nil {
+		t.Fatal(err)
+	}
+	found, err := db.Find(e.GetID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Name != "Alice" {
+		t.Fatalf("Find after MemStorage-backed Insert = %+v, want Name=Alice", found)
+	}
+	if db.GetCount() != 1 {
+		t.Fatalf("GetCount with MemStorage backend = %d, want 1", db.GetCount())
+	}
+
+	// Disk was never touched: the path doesn't exist as a real directory.
+	if _, err := os.Stat("memtest"); !os.IsNotExist(err) {
+		t.Fatalf("MemStorage-backed FileDB wrote to disk at %q", "memtest")
+	}
+}
@@ -0,0 +1,72 @@
+package filedb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// IndexCodec controls how a single index file's entries are serialized.
+// EncodeEntry appends one entry to an open file; DecodeEntry reads the
+// next one back, returning io.EOF once the file is exhausted. fileIndex
+// calls DecodeEntry in a loop until it sees io.EOF or a non-nil,
+// non-EOF error, which LoadIndex returns as is. Init falls back to
+// RebuildIndex only when that error is an *InvalidIndexError; any other
+// error is returned from Init.
+type IndexCodec interface {
+	EncodeEntry(w io.Writer, key string, entry *IndexEntry) error
+	DecodeEntry(r *bufio.Reader) (key string, entry *IndexEntry, err error)
+}
+
+// TabIndexCodec is the default IndexCodec: one entry per line,
+// tab-separated (key, ID, the number of Others, then each Others name and
+// value), with every value backslash-escaped (via escapeKeyPart/
+// unescapeKeyPart) so a field value containing a literal tab or newline
+// can't be mistaken for a separator or a line break and corrupt the rest
+// of the file. An index file in the layout Save wrote before IndexCodec
+// existed (key, ID, then the bare Include values) has no count column, so
+// DecodeEntry rejects it with *InvalidIndexError unless a line's third
+// column happens to parse as a count matching its length. Init treats that
+// error as a signal to RebuildIndex — the next Checkpoint then rewrites
+// the file in this escaped format.
+type TabIndexCodec struct{}
+
+func (TabIndexCodec) EncodeEntry(w io.Writer, key string, entry *IndexEntry) error {
+	fields := make([]string, 0, 3+2*len(entry.Others))
+	fields = append(fields, escapeKeyPart(key), strconv.Itoa(entry.ID), strconv.Itoa(len(entry.Others)))
+	for name, value := range entry.Others {
+		fields = append(fields, escapeKeyPart(name), escapeKeyPart(value))
+	}
+	_, err := fmt.Fprintln(w, strings.Join(fields, "\t"))
+	return err
+}
+
+func (TabIndexCodec) DecodeEntry(r *bufio.Reader) (string, *IndexEntry, error) {
+	line, err := r.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", nil, err
+	}
+	line = strings.TrimRight(line, "\n")
+
+	parts := strings.Split(line, "\t")
+	if len(parts) < 3 {
+		return "", nil, &InvalidIndexError{Message: "invalid index file format"}
+	}
+	id, convErr := strconv.Atoi(parts[1])
+	if convErr != nil {
+		return "", nil, &InvalidIndexError{Message: "invalid index file format"}
+	}
+	n, convErr := strconv.Atoi(parts[2])
+	if convErr != nil || n < 0 || len(parts) != 3+2*n {
+		return "", nil, &InvalidIndexError{Message: "invalid index file format"}
+	}
+	others := make(map[string]string, n)
+	for i := 0; i < n; i++ {
+		others[unescapeKeyPart(parts[3+2*i])] = unescapeKeyPart(parts[3+2*i+1])
+	}
+	key := unescapeKeyPart(parts[0])
+	entry := &IndexEntry{Value: key, ID: id, Others: others}
+	return key, entry, nil
+}
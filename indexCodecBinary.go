@@ -0,0 +1,90 @@
+package filedb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// BinaryIndexCodec frames each entry as a varint record length followed by
+// that many raw bytes, the same length-prefixed-record shape
+// modernc.org/ql used for its V2 format to get past the ~64KB limit its
+// fixed-width V1 records had. Unlike TabIndexCodec nothing here needs
+// escaping: every string is written as its own length-prefixed byte run,
+// so a literal tab or newline in a field value is just more payload.
+type BinaryIndexCodec struct{}
+
+func (BinaryIndexCodec) EncodeEntry(w io.Writer, key string, entry *IndexEntry) error {
+	buf := make([]byte, 0, 32+len(key))
+	buf = appendUvarintString(buf, key)
+	buf = binary.AppendUvarint(buf, uint64(entry.ID))
+	buf = binary.AppendUvarint(buf, uint64(len(entry.Others)))
+	for name, value := range entry.Others {
+		buf = appendUvarintString(buf, name)
+		buf = appendUvarintString(buf, value)
+	}
+
+	lenBuf := binary.AppendUvarint(nil, uint64(len(buf)))
+	if _, err := w.Write(lenBuf); err != nil {
+		return err
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+func (BinaryIndexCodec) DecodeEntry(r *bufio.Reader) (string, *IndexEntry, error) {
+	recLen, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", nil, err
+	}
+	buf := make([]byte, recLen)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", nil, &InvalidIndexError{Message: "invalid index file format"}
+	}
+
+	rr := bufio.NewReader(bytes.NewReader(buf))
+	key, err := readUvarintString(rr)
+	if err != nil {
+		return "", nil, &InvalidIndexError{Message: "invalid index file format"}
+	}
+	id64, err := binary.ReadUvarint(rr)
+	if err != nil {
+		return "", nil, &InvalidIndexError{Message: "invalid index file format"}
+	}
+	n, err := binary.ReadUvarint(rr)
+	if err != nil {
+		return "", nil, &InvalidIndexError{Message: "invalid index file format"}
+	}
+	others := make(map[string]string, n)
+	for i := uint64(0); i < n; i++ {
+		name, err := readUvarintString(rr)
+		if err != nil {
+			return "", nil, &InvalidIndexError{Message: "invalid index file format"}
+		}
+		value, err := readUvarintString(rr)
+		if err != nil {
+			return "", nil, &InvalidIndexError{Message: "invalid index file format"}
+		}
+		others[name] = value
+	}
+	return key, &IndexEntry{Value: key, ID: int(id64), Others: others}, nil
+}
+
+func appendUvarintString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func readUvarintString(r *bufio.Reader) (string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", fmt.Errorf("index: truncated string: %w", err)
+	}
+	return string(buf), nil
+}
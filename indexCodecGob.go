@@ -0,0 +1,39 @@
+package filedb
+
+import (
+	"bufio"
+	"encoding/gob"
+	"io"
+)
+
+// gobIndexRecord is the wire type GobIndexCodec encodes/decodes; it exists
+// only to pair IndexEntry with the key it was filed under, since
+// IndexEntry.Value already duplicates that key informally but fileIndex
+// treats the two as independent.
+type gobIndexRecord struct {
+	Key   string
+	Entry IndexEntry
+}
+
+// GobIndexCodec encodes each entry as its own gob value. gob streams
+// multiple values back to back without any extra framing of our own —
+// Decoder.Decode consumes exactly the bytes of the next value and leaves
+// the reader positioned at the start of the one after it — so repeated
+// EncodeEntry/DecodeEntry calls against the same file behave the same as
+// TabIndexCodec's one-line-per-entry layout.
+type GobIndexCodec struct{}
+
+func (GobIndexCodec) EncodeEntry(w io.Writer, key string, entry *IndexEntry) error {
+	return gob.NewEncoder(w).Encode(gobIndexRecord{Key: key, Entry: *entry})
+}
+
+func (GobIndexCodec) DecodeEntry(r *bufio.Reader) (string, *IndexEntry, error) {
+	var rec gobIndexRecord
+	if err := gob.NewDecoder(r).Decode(&rec); err != nil {
+		if err == io.EOF {
+			return "", nil, io.EOF
+		}
+		return "", nil, &InvalidIndexError{Message: "invalid index file format"}
+	}
+	return rec.Key, &rec.Entry, nil
+}
@@ -0,0 +1,106 @@
+package filedb
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"testing"
+)
+
+func roundTripCodec(t *testing.T, codec IndexCodec, key string, entry *IndexEntry) (string, *IndexEntry) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := codec.EncodeEntry(&buf, key, entry); err != nil {
+		t.Fatalf("EncodeEntry failed: %v", err)
+	}
+	gotKey, gotEntry, err := codec.DecodeEntry(bufio.NewReader(&buf))
+	if err != nil {
+		t.Fatalf("DecodeEntry failed: %v", err)
+	}
+	return gotKey, gotEntry
+}
+
+func TestIndexCodecsRoundTrip(t *testing.T) {
+	codecs := map[string]IndexCodec{
+		"Tab":    TabIndexCodec{},
+		"Binary": BinaryIndexCodec{},
+		"Gob":    GobIndexCodec{},
+	}
+	for name, codec := range codecs {
+		t.Run(name, func(t *testing.T) {
+			entry := &IndexEntry{ID: 42, Others: map[string]string{"City": "NYC", "Status": "active"}}
+			gotKey, gotEntry := roundTripCodec(t, codec, "Alice", entry)
+			if gotKey != "Alice" {
+				t.Errorf("key = %q, want %q", gotKey, "Alice")
+			}
+			if gotEntry.ID != entry.ID {
+				t.Errorf("ID = %d, want %d", gotEntry.ID, entry.ID)
+			}
+			if gotEntry.Others["City"] != "NYC" || gotEntry.Others["Status"] != "active" {
+				t.Errorf("Others = %v, want %v", gotEntry.Others, entry.Others)
+			}
+		})
+	}
+}
+
+// TestIndexCodecsSurviveTabsAndNewlines is the regression this codec exists
+// for: a field value containing the bytes a hand-rolled tab-delimited
+// format used as separators must still round-trip intact.
+func TestIndexCodecsSurviveTabsAndNewlines(t *testing.T) {
+	codecs := map[string]IndexCodec{
+		"Tab":    TabIndexCodec{},
+		"Binary": BinaryIndexCodec{},
+		"Gob":    GobIndexCodec{},
+	}
+	key := "a\tb\nc"
+	entry := &IndexEntry{ID: 7, Others: map[string]string{"Note": "tab\there\nand newline"}}
+	for name, codec := range codecs {
+		t.Run(name, func(t *testing.T) {
+			gotKey, gotEntry := roundTripCodec(t, codec, key, entry)
+			if gotKey != key {
+				t.Errorf("key = %q, want %q", gotKey, key)
+			}
+			if gotEntry.Others["Note"] != entry.Others["Note"] {
+				t.Errorf("Others[Note] = %q, want %q", gotEntry.Others["Note"], entry.Others["Note"])
+			}
+		})
+	}
+}
+
+func TestIndexCodecsMultipleEntriesInOneFile(t *testing.T) {
+	codecs := map[string]IndexCodec{
+		"Tab":    TabIndexCodec{},
+		"Binary": BinaryIndexCodec{},
+		"Gob":    GobIndexCodec{},
+	}
+	for name, codec := range codecs {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := codec.EncodeEntry(&buf, "Alice", &IndexEntry{ID: 1}); err != nil {
+				t.Fatalf("EncodeEntry failed: %v", err)
+			}
+			if err := codec.EncodeEntry(&buf, "Bob", &IndexEntry{ID: 2}); err != nil {
+				t.Fatalf("EncodeEntry failed: %v", err)
+			}
+
+			r := bufio.NewReader(&buf)
+			key1, entry1, err := codec.DecodeEntry(r)
+			if err != nil {
+				t.Fatalf("first DecodeEntry failed: %v", err)
+			}
+			if key1 != "Alice" || entry1.ID != 1 {
+				t.Errorf("first entry = (%q, %d), want (Alice, 1)", key1, entry1.ID)
+			}
+			key2, entry2, err := codec.DecodeEntry(r)
+			if err != nil {
+				t.Fatalf("second DecodeEntry failed: %v", err)
+			}
+			if key2 != "Bob" || entry2.ID != 2 {
+				t.Errorf("second entry = (%q, %d), want (Bob, 2)", key2, entry2.ID)
+			}
+			if _, _, err := codec.DecodeEntry(r); err != io.EOF {
+				t.Errorf("DecodeEntry past end = %v, want io.EOF", err)
+			}
+		})
+	}
+}
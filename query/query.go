@@ -0,0 +1,311 @@
+// Package query provides a small expression tree for FileDB lookups that
+// compiles each node against the indexes a FileDB was configured with,
+// intersecting or unioning ID slices instead of hydrating every candidate
+// record up front.
+package query
+
+import (
+	"sort"
+
+	"github.com/dannyswat/filedb"
+)
+
+// Expr is a node in a query expression tree built with Eq, In, Range, And,
+// Or and Not.
+type Expr interface {
+	eval(ctx evalContext) []int
+}
+
+// evalContext is implemented by *Plan[T] for any T, so Expr stays
+// non-generic while still being able to reach a specific FileDB's indexes.
+// hasIndex/hasRangeIndex let a leaf node pick between an index lookup and
+// the scanEq/scanRange full-scan fallback, which compare field values on
+// hydrated records since an un-indexed field has no ID-only lookup path.
+// isPartialIndex reports whether that index only covers a subset of
+// records (declared with a Where predicate), in which case a lookup node
+// must fall back to scanning rather than trust the index as complete.
+type evalContext interface {
+	searchIds(field string, value string) []int
+	rangeIds(field, lo, hi string) []int
+	allIds() []int
+	hasIndex(field string) bool
+	hasRangeIndex(field string) bool
+	isPartialIndex(field string) bool
+	scanEq(field, value string) []int
+	scanRange(field, lo, hi string) []int
+}
+
+type eqExpr struct {
+	field string
+	value string
+}
+
+// Eq matches records whose field equals value.
+func Eq(field, value string) Expr { return &eqExpr{field, value} }
+
+func (e *eqExpr) eval(ctx evalContext) []int {
+	if ctx.hasIndex(e.field) && !ctx.isPartialIndex(e.field) {
+		return sortInts(ctx.searchIds(e.field, e.value))
+	}
+	return ctx.scanEq(e.field, e.value)
+}
+
+type inExpr struct {
+	field  string
+	values []string
+}
+
+// In matches records whose field equals any of values.
+func In(field string, values ...string) Expr { return &inExpr{field, values} }
+
+func (e *inExpr) eval(ctx evalContext) []int {
+	if len(e.values) == 0 {
+		return nil
+	}
+	result := (&eqExpr{e.field, e.values[0]}).eval(ctx)
+	for _, v := range e.values[1:] {
+		result = union(result, (&eqExpr{e.field, v}).eval(ctx))
+	}
+	return result
+}
+
+type rangeExpr struct {
+	field  string
+	lo, hi string
+}
+
+// Range matches records whose field falls in [lo, hi).
+func Range(field, lo, hi string) Expr { return &rangeExpr{field, lo, hi} }
+
+func (e *rangeExpr) eval(ctx evalContext) []int {
+	if ctx.hasRangeIndex(e.field) && !ctx.isPartialIndex(e.field) {
+		return sortInts(ctx.rangeIds(e.field, e.lo, e.hi))
+	}
+	return ctx.scanRange(e.field, e.lo, e.hi)
+}
+
+type andExpr struct{ exprs []Expr }
+
+// And matches records that satisfy every expr.
+func And(exprs ...Expr) Expr { return &andExpr{exprs} }
+
+func (e *andExpr) eval(ctx evalContext) []int {
+	if len(e.exprs) == 0 {
+		return nil
+	}
+	result := e.exprs[0].eval(ctx)
+	for _, sub := range e.exprs[1:] {
+		result = intersect(result, sub.eval(ctx))
+	}
+	return result
+}
+
+type orExpr struct{ exprs []Expr }
+
+// Or matches records that satisfy at least one expr.
+func Or(exprs ...Expr) Expr { return &orExpr{exprs} }
+
+func (e *orExpr) eval(ctx evalContext) []int {
+	var result []int
+	for _, sub := range e.exprs {
+		result = union(result, sub.eval(ctx))
+	}
+	return result
+}
+
+type notExpr struct{ expr Expr }
+
+// Not matches every record that expr does not.
+func Not(expr Expr) Expr { return &notExpr{expr} }
+
+func (e *notExpr) eval(ctx evalContext) []int {
+	return difference(sortInts(ctx.allIds()), e.expr.eval(ctx))
+}
+
+func sortInts(ids []int) []int {
+	sort.Ints(ids)
+	return ids
+}
+
+// intersect returns the sorted IDs present in both a and b.
+func intersect(a, b []int) []int {
+	result := make([]int, 0, min(len(a), len(b)))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			result = append(result, a[i])
+			i++
+			j++
+		}
+	}
+	return result
+}
+
+// union returns the sorted, deduplicated IDs present in a or b.
+func union(a, b []int) []int {
+	result := make([]int, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			result = append(result, a[i])
+			i++
+		case a[i] > b[j]:
+			result = append(result, b[j])
+			j++
+		default:
+			result = append(result, a[i])
+			i++
+			j++
+		}
+	}
+	result = append(result, a[i:]...)
+	result = append(result, b[j:]...)
+	return result
+}
+
+// difference returns the sorted IDs in a that are not in b.
+func difference(a, b []int) []int {
+	result := make([]int, 0, len(a))
+	i, j := 0, 0
+	for i < len(a) {
+		if j >= len(b) || a[i] < b[j] {
+			result = append(result, a[i])
+			i++
+		} else if a[i] > b[j] {
+			j++
+		} else {
+			i++
+			j++
+		}
+	}
+	return result
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Plan is a compiled query against a specific FileDB, built by Query and
+// refined with Limit, Offset and OrderBy before Iterate runs it.
+type Plan[T filedb.FileEntity] struct {
+	db        filedb.FileDB[T]
+	expr      Expr
+	limit     int
+	offset    int
+	orderBy   string
+	ascending bool
+}
+
+// Query compiles expr against db. Call Iterate to run it.
+func Query[T filedb.FileEntity](db filedb.FileDB[T], expr Expr) *Plan[T] {
+	return &Plan[T]{db: db, expr: expr, ascending: true}
+}
+
+// Limit caps the number of records Iterate yields. n <= 0 means unlimited.
+func (p *Plan[T]) Limit(n int) *Plan[T] {
+	p.limit = n
+	return p
+}
+
+// Offset skips the first n matching records before Iterate starts yielding.
+func (p *Plan[T]) Offset(n int) *Plan[T] {
+	p.offset = n
+	return p
+}
+
+// OrderBy sorts matching records by field (via GetValue) before Limit and
+// Offset are applied. An empty field leaves results in ID order.
+func (p *Plan[T]) OrderBy(field string, asc bool) *Plan[T] {
+	p.orderBy = field
+	p.ascending = asc
+	return p
+}
+
+// Iterate evaluates the plan and calls fn once per matching record in
+// order, stopping as soon as fn returns false.
+func (p *Plan[T]) Iterate(fn func(T) bool) error {
+	ids := sortInts(p.expr.eval(p))
+
+	entities := make([]T, 0, len(ids))
+	for _, id := range ids {
+		e, err := p.db.Find(id)
+		if err != nil {
+			return err
+		}
+		entities = append(entities, e)
+	}
+
+	if p.orderBy != "" {
+		sort.SliceStable(entities, func(i, j int) bool {
+			if p.ascending {
+				return entities[i].GetValue(p.orderBy) < entities[j].GetValue(p.orderBy)
+			}
+			return entities[i].GetValue(p.orderBy) > entities[j].GetValue(p.orderBy)
+		})
+	}
+
+	if p.offset > 0 {
+		if p.offset >= len(entities) {
+			return nil
+		}
+		entities = entities[p.offset:]
+	}
+	if p.limit > 0 && len(entities) > p.limit {
+		entities = entities[:p.limit]
+	}
+
+	for _, e := range entities {
+		if !fn(e) {
+			break
+		}
+	}
+	return nil
+}
+
+// evalContext implementation, backed by the plan's FileDB.
+
+func (p *Plan[T]) searchIds(field, value string) []int { return p.db.SearchIds(field, value) }
+func (p *Plan[T]) rangeIds(field, lo, hi string) []int { return p.db.RangeIds(field, lo, hi) }
+func (p *Plan[T]) allIds() []int                       { return p.db.AllIds() }
+func (p *Plan[T]) hasIndex(field string) bool          { return p.db.HasIndex(field) }
+func (p *Plan[T]) hasRangeIndex(field string) bool     { return p.db.HasRangeIndex(field) }
+func (p *Plan[T]) isPartialIndex(field string) bool    { return p.db.IsPartialIndex(field) }
+
+// scanEq is the fallback for a field with no index: it hydrates every
+// record and keeps the ones whose field equals value.
+func (p *Plan[T]) scanEq(field, value string) []int {
+	return p.scan(func(e T) bool { return e.GetValue(field) == value })
+}
+
+// scanRange is the fallback for a field with no B-tree index: it hydrates
+// every record and keeps the ones whose field falls in [lo, hi).
+func (p *Plan[T]) scanRange(field, lo, hi string) []int {
+	return p.scan(func(e T) bool {
+		v := e.GetValue(field)
+		return v >= lo && v < hi
+	})
+}
+
+func (p *Plan[T]) scan(match func(e T) bool) []int {
+	ids := sortInts(p.db.AllIds())
+	result := make([]int, 0, len(ids))
+	for _, id := range ids {
+		e, err := p.db.Find(id)
+		if err != nil {
+			continue
+		}
+		if match(e) {
+			result = append(result, id)
+		}
+	}
+	return result
+}
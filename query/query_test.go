@@ -0,0 +1,208 @@
+package query
+
+import (
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/dannyswat/filedb"
+)
+
+type testPerson struct {
+	ID   int
+	Name string
+	Age  int
+	City string
+}
+
+func newTestPerson(name string, age int, city string) *testPerson {
+	return &testPerson{Name: name, Age: age, City: city}
+}
+
+func (p *testPerson) GetID() int    { return p.ID }
+func (p *testPerson) SetID(id int)  { p.ID = id }
+func (p *testPerson) GetValue(field string) string {
+	switch field {
+	case "Name":
+		return p.Name
+	case "Age":
+		return strconv.Itoa(p.Age)
+	case "City":
+		return p.City
+	}
+	return ""
+}
+
+func newTestDB(t *testing.T) filedb.FileDB[*testPerson] {
+	os.RemoveAll("querytest")
+	t.Cleanup(func() { os.RemoveAll("querytest") })
+	db := filedb.NewFileDB[*testPerson]("querytest", []filedb.FileIndexConfig{
+		{Unique: true, Field: "Name"},
+		{Unique: false, Field: "Age", Kind: filedb.IndexBTree},
+		{Unique: false, Field: "City"},
+	})
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []*testPerson{
+		newTestPerson("Alice", 20, "NYC"),
+		newTestPerson("Bob", 30, "NYC"),
+		newTestPerson("Carol", 20, "LA"),
+		newTestPerson("Dave", 40, "LA"),
+	} {
+		if err := db.Insert(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func names(people []*testPerson) []string {
+	result := make([]string, len(people))
+	for i, p := range people {
+		result[i] = p.Name
+	}
+	return result
+}
+
+func runQuery(t *testing.T, db filedb.FileDB[*testPerson], p *Plan[*testPerson]) []*testPerson {
+	var out []*testPerson
+	if err := p.Iterate(func(e *testPerson) bool {
+		out = append(out, e)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestEqUsesIndex(t *testing.T) {
+	db := newTestDB(t)
+	people := runQuery(t, db, Query(db, Eq("Name", "Bob")))
+	if got := names(people); len(got) != 1 || got[0] != "Bob" {
+		t.Errorf("Eq(Name, Bob) = %v", got)
+	}
+}
+
+func TestAndIntersectsAcrossIndexes(t *testing.T) {
+	db := newTestDB(t)
+	people := runQuery(t, db, Query(db, And(Eq("Age", "20"), Eq("City", "NYC"))))
+	if got := names(people); len(got) != 1 || got[0] != "Alice" {
+		t.Errorf("And(Age=20, City=NYC) = %v", got)
+	}
+}
+
+func TestOrUnionsResults(t *testing.T) {
+	db := newTestDB(t)
+	people := runQuery(t, db, Query(db, Or(Eq("Name", "Alice"), Eq("Name", "Dave"))))
+	if got := names(people); len(got) != 2 {
+		t.Errorf("Or(Alice, Dave) = %v", got)
+	}
+}
+
+func TestNotExcludesMatches(t *testing.T) {
+	db := newTestDB(t)
+	people := runQuery(t, db, Query(db, Not(Eq("City", "NYC"))))
+	if got := names(people); len(got) != 2 {
+		t.Errorf("Not(City=NYC) = %v", got)
+	}
+}
+
+// TestNotWithPartialFirstIndex is the regression for Not deriving its
+// "everything" universe from AllIds, which used to come solely from the
+// first configured index: with that index restricted by a Where, the two
+// records it excludes must still turn up here.
+func TestNotWithPartialFirstIndex(t *testing.T) {
+	os.RemoveAll("querytest_partial")
+	t.Cleanup(func() { os.RemoveAll("querytest_partial") })
+	db := filedb.NewFileDB[*testPerson]("querytest_partial", []filedb.FileIndexConfig{
+		{Unique: false, Field: "City", Where: func(e filedb.FileEntity) bool {
+			return e.GetValue("Name") == "Alice" || e.GetValue("Name") == "Bob"
+		}},
+	})
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []*testPerson{
+		newTestPerson("Alice", 20, "NYC"),
+		newTestPerson("Bob", 30, "NYC"),
+		newTestPerson("Carol", 20, "LA"),
+		newTestPerson("Dave", 40, "LA"),
+	} {
+		if err := db.Insert(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	people := runQuery(t, db, Query(db, Not(Eq("Name", "Alice"))))
+	if got := names(people); len(got) != 3 {
+		t.Errorf("Not(Name=Alice) with a partial first index = %v, want the other 3 records", got)
+	}
+}
+
+func TestRangeOnBTreeField(t *testing.T) {
+	db := newTestDB(t)
+	people := runQuery(t, db, Query(db, Range("Age", "20", "35")))
+	if got := names(people); len(got) != 3 {
+		t.Errorf("Range(Age, 20, 35) = %v", got)
+	}
+}
+
+func TestOrderByLimitOffset(t *testing.T) {
+	db := newTestDB(t)
+	people := runQuery(t, db, Query(db, In("City", "NYC", "LA")).OrderBy("Age", true).Offset(1).Limit(2))
+	if got := names(people); len(got) != 2 || got[0] != "Carol" {
+		t.Errorf("ordered/paged query = %v", got)
+	}
+}
+
+func TestEqFallsBackToScanForUnindexedField(t *testing.T) {
+	db := newTestDB(t)
+	// "Name" has an index but a made-up field doesn't; the scan fallback
+	// should still return zero matches rather than erroring.
+	people := runQuery(t, db, Query(db, Eq("Nickname", "Al")))
+	if len(people) != 0 {
+		t.Errorf("Eq on unindexed field = %v, want none", people)
+	}
+}
+
+// TestEqAndRangeFallBackToScanForPartialIndex is the regression for Eq and
+// Range trusting hasIndex/hasRangeIndex as "this index covers every record
+// for the field", which a partial (Where-restricted) index doesn't: a
+// record outside the predicate was never added to the index at all, so an
+// index lookup silently omits it. Both must fall back to a full scan for a
+// partial-indexed field instead.
+func TestEqAndRangeFallBackToScanForPartialIndex(t *testing.T) {
+	os.RemoveAll("querytest_partial_eq")
+	t.Cleanup(func() { os.RemoveAll("querytest_partial_eq") })
+	db := filedb.NewFileDB[*testPerson]("querytest_partial_eq", []filedb.FileIndexConfig{
+		{Unique: false, Field: "Age", Kind: filedb.IndexBTree, Where: func(e filedb.FileEntity) bool {
+			return e.GetValue("City") == "NYC"
+		}},
+	})
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []*testPerson{
+		newTestPerson("Alice", 20, "NYC"),
+		newTestPerson("Bob", 30, "NYC"),
+		newTestPerson("Carol", 20, "LA"),
+		newTestPerson("Dave", 40, "LA"),
+	} {
+		if err := db.Insert(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Carol is 20 but lives in LA, so she was never added to the partial
+	// "Age" index; Eq/Range must still surface her via the scan fallback.
+	eq := runQuery(t, db, Query(db, Eq("Age", "20")))
+	if got := names(eq); len(got) != 2 {
+		t.Errorf("Eq(Age, 20) with a partial Age index = %v, want Alice and Carol", got)
+	}
+
+	rng := runQuery(t, db, Query(db, Range("Age", "20", "21")))
+	if got := names(rng); len(got) != 2 {
+		t.Errorf("Range(Age, 20, 21) with a partial Age index = %v, want Alice and Carol", got)
+	}
+}
@@ -0,0 +1,117 @@
+package filedb
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/dannyswat/filedb/replication"
+	"github.com/dannyswat/filedb/storage"
+)
+
+// Replica is a read-only FileDB kept in sync with a primary over a
+// replication.Transport: it bootstraps from the primary's Snapshot on
+// first Sync, then applies whatever the primary's StreamFrom reports after
+// that, re-snapshotting on its own if the primary ever reports a gap.
+type Replica[T FileEntity] struct {
+	path      string
+	db        FileDB[T]
+	transport replication.Transport
+	lastLSN   uint64
+}
+
+// NewReplica creates a Replica backed by a local FileDB rooted at path,
+// configured with the same indexes as the primary, following the primary
+// reachable at primaryURL (a base URL served by replication.Serve on the
+// primary side). It does not fetch anything until Sync or Start is called.
+func NewReplica[T FileEntity](path, primaryURL string, indexes []FileIndexConfig) (*Replica[T], error) {
+	return &Replica[T]{
+		path:      path,
+		db:        NewFileDB[T](path, indexes),
+		transport: replication.NewHTTPClient(primaryURL),
+	}, nil
+}
+
+// Sync runs one round of replication: if the local DB hasn't bootstrapped
+// yet, it fetches and extracts a full Snapshot; otherwise it streams
+// everything after the last LSN it applied and replays it. A gap reported
+// by the primary (its log has been truncated past what this replica has
+// seen) falls back to a fresh Snapshot.
+func (r *Replica[T]) Sync() error {
+	if r.lastLSN == 0 {
+		if err := r.bootstrap(); err != nil {
+			return err
+		}
+	}
+	stream, err := r.transport.OpenStream(r.lastLSN)
+	var gap *replication.ErrGap
+	if errors.As(err, &gap) {
+		return r.bootstrap()
+	}
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	records, err := replication.DecodeRecords(stream)
+	if err != nil {
+		return err
+	}
+	for _, rec := range records {
+		if err := r.db.ApplyReplicated(rec.Op, rec.ID, rec.Data); err != nil {
+			return err
+		}
+		r.lastLSN = rec.LSN
+	}
+	return nil
+}
+
+func (r *Replica[T]) bootstrap() error {
+	snapshot, err := r.transport.FetchSnapshot()
+	if err != nil {
+		return err
+	}
+	defer snapshot.Close()
+
+	disk := storage.NewDiskStorage()
+	if err := r.db.deleteDB(); err != nil {
+		return err
+	}
+	if err := disk.Mkdir(r.path); err != nil {
+		return err
+	}
+	lsn, err := replication.ExtractSnapshot(snapshot, disk, r.path)
+	if err != nil {
+		return err
+	}
+	if err := r.db.Init(); err != nil {
+		return err
+	}
+	r.lastLSN = lsn
+	return nil
+}
+
+// Start calls Sync on a loop, sleeping interval between rounds, until ctx
+// is done.
+func (r *Replica[T]) Start(ctx context.Context, interval time.Duration) error {
+	for {
+		if err := r.Sync(); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// LastLSN returns the LSN this replica has applied up to.
+func (r *Replica[T]) LastLSN() uint64 {
+	return r.lastLSN
+}
+
+// DB returns the replica's local FileDB for read queries.
+func (r *Replica[T]) DB() FileDB[T] {
+	return r.db
+}
@@ -0,0 +1,203 @@
+package filedb
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dannyswat/filedb/replication"
+	"github.com/dannyswat/filedb/storage"
+)
+
+func newReplicationTestDB(t *testing.T, path string) FileDB[*TestEntity] {
+	os.RemoveAll(path)
+	t.Cleanup(func() { os.RemoveAll(path) })
+	db := NewFileDB[*TestEntity](path, []FileIndexConfig{{Unique: true, Field: "Name"}})
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestReplicaCatchesUpAfterLag(t *testing.T) {
+	primary := newReplicationTestDB(t, "replprimary1")
+	server := httptest.NewServer(NewReplicationHandler[*TestEntity](primary))
+	defer server.Close()
+
+	if err := primary.Insert(NewTestEntity("Alice", 20)); err != nil {
+		t.Fatal(err)
+	}
+
+	os.RemoveAll("replreplica1")
+	t.Cleanup(func() { os.RemoveAll("replreplica1") })
+	replica, err := NewReplica[*TestEntity]("replreplica1", server.URL, []FileIndexConfig{{Unique: true, Field: "Name"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := replica.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if got := replica.DB().GetCount(); got != 1 {
+		t.Fatalf("after bootstrap, replica count = %d, want 1", got)
+	}
+
+	if err := primary.Insert(NewTestEntity("Bob", 30)); err != nil {
+		t.Fatal(err)
+	}
+	if err := primary.Insert(NewTestEntity("Carol", 40)); err != nil {
+		t.Fatal(err)
+	}
+	if err := replica.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if got := replica.DB().GetCount(); got != 3 {
+		t.Fatalf("after catch-up sync, replica count = %d, want 3", got)
+	}
+	if replica.LastLSN() != primary.LastLSN() {
+		t.Fatalf("replica lsn %d != primary lsn %d", replica.LastLSN(), primary.LastLSN())
+	}
+}
+
+// TestSnapshotDuringWritesIsConsistent checks that Snapshot's lsn never
+// reports a point ahead of what concurrent writers actually reached, even
+// though it runs while Insert calls are in flight on another goroutine.
+func TestSnapshotDuringWritesIsConsistent(t *testing.T) {
+	primary := newReplicationTestDB(t, "replprimary2")
+
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < 20; i++ {
+			if err := primary.Insert(NewTestEntity("writer"+strconv.Itoa(i), i)); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	var buf bytes.Buffer
+	lsn, err := primary.Snapshot(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if lsn > primary.LastLSN() {
+		t.Fatalf("snapshot lsn %d is ahead of primary's own lsn %d", lsn, primary.LastLSN())
+	}
+
+	os.RemoveAll("replrestored2")
+	t.Cleanup(func() { os.RemoveAll("replrestored2") })
+	disk := storage.NewDiskStorage()
+	if err := disk.Mkdir("replrestored2"); err != nil {
+		t.Fatal(err)
+	}
+	lsnExtracted, err := replication.ExtractSnapshot(&buf, disk, "replrestored2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lsnExtracted != lsn {
+		t.Fatalf("extracted snapshot lsn %d != reported lsn %d", lsnExtracted, lsn)
+	}
+}
+
+func TestReplicaReconnectWithGapResnapshots(t *testing.T) {
+	primary := newReplicationTestDB(t, "replprimary3")
+	if err := primary.Insert(NewTestEntity("Alice", 20)); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(NewReplicationHandler[*TestEntity](primary))
+	defer server.Close()
+
+	os.RemoveAll("replreplica3")
+	t.Cleanup(func() { os.RemoveAll("replreplica3") })
+	replica, err := NewReplica[*TestEntity]("replreplica3", server.URL, []FileIndexConfig{{Unique: true, Field: "Name"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := replica.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := primary.Insert(NewTestEntity("Bob", 30)); err != nil {
+		t.Fatal(err)
+	}
+	// Simulate the primary having pruned its log past what the replica has
+	// already applied, as a long-lagging replica would find on reconnect.
+	if err := primary.(*fileDB[*TestEntity]).repl.Truncate(primary.LastLSN()); err != nil {
+		t.Fatal(err)
+	}
+	if err := primary.Insert(NewTestEntity("Carol", 40)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := replica.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if got := replica.DB().GetCount(); got != primary.GetCount() {
+		t.Fatalf("after gap resnapshot, replica count = %d, want %d", got, primary.GetCount())
+	}
+	if replica.LastLSN() != primary.LastLSN() {
+		t.Fatalf("after gap resnapshot, replica lsn %d != primary lsn %d", replica.LastLSN(), primary.LastLSN())
+	}
+}
+
+func TestWaitForLSNUnblocksAfterWrite(t *testing.T) {
+	db := newReplicationTestDB(t, "replwait1")
+	target := db.LastLSN() + 1
+
+	unblocked := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		unblocked <- db.WaitForLSN(ctx, target)
+	}()
+
+	if err := db.Insert(NewTestEntity("Alice", 20)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-unblocked:
+		if err != nil {
+			t.Fatalf("WaitForLSN returned %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("WaitForLSN did not unblock after the write")
+	}
+}
+
+// TestWaitForLSNExitsOnCancelWithoutReachingTarget reproduces a per-call
+// goroutine leak: if WaitForLSN's worker goroutine only re-checked LastLSN
+// (not ctx.Err()) after being woken, a cancelled call whose target LSN is
+// never reached would wake once and then block in lsnCond.Wait() forever.
+// Asking for an LSN far past anything this DB will ever reach and letting
+// ctx expire proves the worker actually exits instead of leaking.
+func TestWaitForLSNExitsOnCancelWithoutReachingTarget(t *testing.T) {
+	db := newReplicationTestDB(t, "replwait2")
+	unreachable := db.LastLSN() + 1000
+
+	before := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := db.WaitForLSN(ctx, unreachable); err != ctx.Err() {
+		t.Fatalf("WaitForLSN returned %v, want %v", err, ctx.Err())
+	}
+
+	// WaitForLSN already waits for its worker to exit before returning, so
+	// the goroutine count should be back to baseline with no polling needed.
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := runtime.NumGoroutine(); got > before {
+		t.Fatalf("NumGoroutine() = %d after WaitForLSN returned, want <= %d (baseline): its worker goroutine leaked", got, before)
+	}
+}
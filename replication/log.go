@@ -0,0 +1,269 @@
+// Package replication provides the building blocks a primary FileDB uses to
+// ship its write stream to read replicas: a durable, LSN-ordered log of
+// applied operations, a tar-based snapshot format for bootstrapping a new
+// replica, and the HTTP plumbing to move both over the wire.
+package replication
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/dannyswat/filedb/storage"
+)
+
+// Op identifies the kind of mutation a Record describes.
+type Op byte
+
+const (
+	OpInsert Op = 1
+	OpUpdate Op = 2
+	OpDelete Op = 3
+)
+
+// Record is a single entry in a primary's replication log: one Insert/
+// Update/Delete tagged with the monotonic log-sequence-number it was
+// assigned, so a replica can tell whether it has seen every record up to
+// some point and detect a gap if it hasn't.
+type Record struct {
+	LSN  uint64
+	Op   Op
+	ID   int
+	Data []byte
+}
+
+// Log is an append-only, CRC32-checksummed file of Records, ordered by LSN.
+// Unlike wal.WAL, which only needs to survive until the next Checkpoint, a
+// Log is read by replicas that may be arbitrarily far behind, so Append
+// never truncates it; callers that want to bound its size should call
+// Truncate once they know no replica still needs the records being
+// dropped.
+type Log struct {
+	mu      sync.Mutex
+	path    string
+	storage storage.Storage
+	file    storage.File
+	lastLSN uint64
+}
+
+func NewLog(path string, s storage.Storage) *Log {
+	return &Log{path: path, storage: s}
+}
+
+// Init opens the log, creating it if it doesn't exist yet, and recovers
+// lastLSN from its current contents so Append can keep assigning LSNs in
+// sequence across restarts.
+func (l *Log) Init() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.storage.Exists(l.path) {
+		file, err := l.storage.Create(l.path)
+		if err != nil {
+			return err
+		}
+		l.file = file
+		return nil
+	}
+
+	records, err := l.readAll()
+	if err != nil {
+		return err
+	}
+	if len(records) > 0 {
+		l.lastLSN = records[len(records)-1].LSN
+	}
+	file, err := l.storage.Open(l.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	l.file = file
+	return nil
+}
+
+// Append assigns rec the next LSN, writes it to the tail of the log, and
+// returns the assigned LSN. It's safe to call concurrently: Insert/Update/
+// Delete can run for different IDs at the same time, and each needs its
+// own LSN assigned without stepping on another goroutine's.
+func (l *Log) Append(op Op, id int, data []byte) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lastLSN++
+	rec := &Record{LSN: l.lastLSN, Op: op, ID: id, Data: data}
+	if _, err := l.file.Write(encodeRecord(rec)); err != nil {
+		l.lastLSN--
+		return 0, err
+	}
+	return rec.LSN, nil
+}
+
+// LastLSN returns the LSN of the most recently appended record, or 0 if the
+// log is empty.
+func (l *Log) LastLSN() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lastLSN
+}
+
+// EarliestLSN returns the LSN of the oldest record still in the log, or 0
+// if the log is empty.
+func (l *Log) EarliestLSN() (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	records, err := l.readAll()
+	if err != nil {
+		return 0, err
+	}
+	if len(records) == 0 {
+		return 0, nil
+	}
+	return records[0].LSN, nil
+}
+
+// ErrGap reports that a replica asked to stream from an LSN the log no
+// longer holds (because Truncate dropped it), so the caller must fall back
+// to a fresh Snapshot instead of trying to catch up from the stream.
+type ErrGap struct {
+	Requested uint64
+	Earliest  uint64
+}
+
+func (e *ErrGap) Error() string {
+	return "replication: requested lsn is older than the log's retention window"
+}
+
+// StreamFrom writes every record with LSN > after, in order, to w. It
+// returns *ErrGap if after is older than the oldest record the log still
+// retains.
+func (l *Log) StreamFrom(after uint64, w io.Writer) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	records, err := l.readAll()
+	if err != nil {
+		return err
+	}
+	if len(records) > 0 && after+1 < records[0].LSN {
+		return &ErrGap{Requested: after, Earliest: records[0].LSN}
+	}
+	for _, rec := range records {
+		if rec.LSN <= after {
+			continue
+		}
+		if _, err := w.Write(encodeRecord(rec)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Truncate drops every record with LSN <= before. Callers are responsible
+// for knowing no replica still needs them.
+func (l *Log) Truncate(before uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	records, err := l.readAll()
+	if err != nil {
+		return err
+	}
+	if l.file != nil {
+		l.file.Close()
+	}
+	file, err := l.storage.Create(l.path)
+	if err != nil {
+		return err
+	}
+	for _, rec := range records {
+		if rec.LSN <= before {
+			continue
+		}
+		if _, err := file.Write(encodeRecord(rec)); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	file.Close()
+	file, err = l.storage.Open(l.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	l.file = file
+	return nil
+}
+
+func encodeRecord(rec *Record) []byte {
+	body := make([]byte, 0, 13+len(rec.Data))
+	lsnBuf := make([]byte, 8)
+	binary.BigEndian.PutUint64(lsnBuf, rec.LSN)
+	body = append(body, lsnBuf...)
+	body = append(body, byte(rec.Op))
+	idBuf := make([]byte, 4)
+	binary.BigEndian.PutUint32(idBuf, uint32(rec.ID))
+	body = append(body, idBuf...)
+	dataLenBuf := make([]byte, 4)
+	binary.BigEndian.PutUint32(dataLenBuf, uint32(len(rec.Data)))
+	body = append(body, dataLenBuf...)
+	body = append(body, rec.Data...)
+
+	crc := crc32.ChecksumIEEE(body)
+	frame := make([]byte, 0, 4+len(body)+4)
+	lenBuf := make([]byte, 4)
+	binary.BigEndian.PutUint32(lenBuf, uint32(len(body)))
+	frame = append(frame, lenBuf...)
+	frame = append(frame, body...)
+	crcBuf := make([]byte, 4)
+	binary.BigEndian.PutUint32(crcBuf, crc)
+	frame = append(frame, crcBuf...)
+	return frame
+}
+
+// DecodeRecords reads every well-formed, checksum-valid record from r. It
+// is used both to recover a Log's own file and to decode a stream a
+// replica received over HTTP.
+func DecodeRecords(r io.Reader) ([]*Record, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]*Record, 0)
+	for {
+		if len(data) < 4 {
+			break
+		}
+		bodyLen := binary.BigEndian.Uint32(data[:4])
+		frameLen := int64(4) + int64(bodyLen) + 4
+		if int64(len(data)) < frameLen {
+			break
+		}
+		body := data[4 : 4+bodyLen]
+		wantCRC := binary.BigEndian.Uint32(data[4+bodyLen : frameLen])
+		if crc32.ChecksumIEEE(body) != wantCRC {
+			break
+		}
+		if len(body) < 17 {
+			break
+		}
+		rec := &Record{
+			LSN: binary.BigEndian.Uint64(body[0:8]),
+			Op:  Op(body[8]),
+			ID:  int(int32(binary.BigEndian.Uint32(body[9:13]))),
+		}
+		dataLen := binary.BigEndian.Uint32(body[13:17])
+		if uint32(len(body)-17) != dataLen {
+			break
+		}
+		rec.Data = append([]byte(nil), body[17:]...)
+		records = append(records, rec)
+		data = data[frameLen:]
+	}
+	return records, nil
+}
+
+func (l *Log) readAll() ([]*Record, error) {
+	file, err := l.storage.Open(l.path, os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return DecodeRecords(file)
+}
@@ -0,0 +1,105 @@
+package replication
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dannyswat/filedb/storage"
+)
+
+func TestLogAppendAndStreamFrom(t *testing.T) {
+	s := storage.NewMemStorage()
+	l := NewLog("/db/_repl.log", s)
+	if err := l.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	if lsn, err := l.Append(OpInsert, 1, []byte("one")); err != nil || lsn != 1 {
+		t.Fatalf("Append #1 = %d, %v", lsn, err)
+	}
+	if lsn, err := l.Append(OpUpdate, 1, []byte("one updated")); err != nil || lsn != 2 {
+		t.Fatalf("Append #2 = %d, %v", lsn, err)
+	}
+	if lsn, err := l.Append(OpDelete, 1, nil); err != nil || lsn != 3 {
+		t.Fatalf("Append #3 = %d, %v", lsn, err)
+	}
+
+	var buf bytes.Buffer
+	if err := l.StreamFrom(1, &buf); err != nil {
+		t.Fatal(err)
+	}
+	records, err := DecodeRecords(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].LSN != 2 || records[1].LSN != 3 {
+		t.Fatalf("StreamFrom(1) = %+v", records)
+	}
+}
+
+func TestLogInitRecoversLastLSN(t *testing.T) {
+	s := storage.NewMemStorage()
+	l := NewLog("/db/_repl.log", s)
+	if err := l.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := l.Append(OpInsert, i, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	l2 := NewLog("/db/_repl.log", s)
+	if err := l2.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if l2.LastLSN() != 3 {
+		t.Fatalf("LastLSN after reopen = %d, want 3", l2.LastLSN())
+	}
+	if lsn, err := l2.Append(OpInsert, 3, nil); err != nil || lsn != 4 {
+		t.Fatalf("Append after reopen = %d, %v", lsn, err)
+	}
+}
+
+func TestLogTruncateReportsGap(t *testing.T) {
+	s := storage.NewMemStorage()
+	l := NewLog("/db/_repl.log", s)
+	if err := l.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := l.Append(OpInsert, i, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Truncate(3); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	err := l.StreamFrom(1, &buf)
+	var gap *ErrGap
+	if err == nil {
+		t.Fatal("expected ErrGap streaming from a truncated lsn")
+	}
+	if g, ok := err.(*ErrGap); !ok {
+		t.Fatalf("expected *ErrGap, got %T: %v", err, err)
+	} else {
+		gap = g
+	}
+	if gap.Earliest != 4 {
+		t.Errorf("gap.Earliest = %d, want 4", gap.Earliest)
+	}
+
+	buf.Reset()
+	if err := l.StreamFrom(3, &buf); err != nil {
+		t.Fatal(err)
+	}
+	records, err := DecodeRecords(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("StreamFrom(3) after truncate = %d records, want 2", len(records))
+	}
+}
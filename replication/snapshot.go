@@ -0,0 +1,134 @@
+package replication
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/dannyswat/filedb/storage"
+)
+
+// lsnEntryName is the tar entry WriteSnapshot stores the snapshot's LSN
+// under, alongside the object and index files it captured.
+const lsnEntryName = "_snapshot.lsn"
+
+// WriteSnapshot walks every file under root (object files nested in
+// per-digit subdirectories, plus the top-level "_*.idx" index files) and
+// writes them, together with lsn, as a tar stream to w. The caller is
+// responsible for holding off writers for the duration of the walk if it
+// wants the snapshot to be consistent with lsn.
+func WriteSnapshot(w io.Writer, s storage.Storage, root string, lsn uint64) error {
+	tw := tar.NewWriter(w)
+	if err := writeSnapshotDir(tw, s, root, ""); err != nil {
+		return err
+	}
+	lsnBytes := []byte(strconv.FormatUint(lsn, 10))
+	if err := tw.WriteHeader(&tar.Header{Name: lsnEntryName, Size: int64(len(lsnBytes)), Mode: 0644}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(lsnBytes); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func writeSnapshotDir(tw *tar.Writer, s storage.Storage, root, relPath string) error {
+	names, err := s.List(root + relPath)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		childRel := relPath + "/" + name
+		if _, err := s.List(root + childRel); err == nil {
+			if err := writeSnapshotDir(tw, s, root, childRel); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := writeSnapshotFile(tw, s, root, childRel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeSnapshotFile(tw *tar.Writer, s storage.Storage, root, relPath string) error {
+	file, err := s.Open(root+relPath, 0, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	name := strings.TrimPrefix(relPath, "/")
+	if err := tw.WriteHeader(&tar.Header{Name: name, Size: int64(len(data)), Mode: 0644}); err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+// mkdirAll creates relDir under root one path segment at a time, since
+// storage.Storage.Mkdir (like the on-disk implementation it models) only
+// creates a single level and expects its parent to already exist.
+func mkdirAll(s storage.Storage, root, relDir string) error {
+	segments := strings.Split(relDir, "/")
+	path := root
+	for _, seg := range segments {
+		if seg == "" {
+			continue
+		}
+		path += "/" + seg
+		if err := s.Mkdir(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExtractSnapshot reads a tar stream written by WriteSnapshot and recreates
+// its files under destDir, returning the LSN the snapshot was taken at.
+func ExtractSnapshot(r io.Reader, s storage.Storage, destDir string) (uint64, error) {
+	tr := tar.NewReader(r)
+	var lsn uint64
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return 0, err
+		}
+		if hdr.Name == lsnEntryName {
+			lsn, err = strconv.ParseUint(string(data), 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("replication: invalid snapshot lsn entry: %w", err)
+			}
+			continue
+		}
+		path := destDir + "/" + hdr.Name
+		if idx := strings.LastIndex(hdr.Name, "/"); idx >= 0 {
+			if err := mkdirAll(s, destDir, hdr.Name[:idx]); err != nil {
+				return 0, err
+			}
+		}
+		file, err := s.Create(path)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := file.Write(data); err != nil {
+			file.Close()
+			return 0, err
+		}
+		file.Close()
+	}
+	return lsn, nil
+}
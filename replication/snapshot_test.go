@@ -0,0 +1,68 @@
+package replication
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dannyswat/filedb/storage"
+)
+
+// Snapshot walks directories by trying List and falling back to a file
+// read when that errors, which only DiskStorage's List (backed by
+// os.ReadDir) distinguishes correctly; MemStorage's List never errors, so
+// these tests use real temp directories like filedb_test.go does for the
+// equivalent index-rebuild walk.
+func TestWriteAndExtractSnapshot(t *testing.T) {
+	src := t.TempDir()
+	disk := storage.NewDiskStorage()
+	if err := os.WriteFile(filepath.Join(src, "_Name.idx"), []byte("Alice\t1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "1.dat"), []byte(`{"ID":1,"Name":"Alice"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteSnapshot(&buf, disk, src, 42); err != nil {
+		t.Fatal(err)
+	}
+
+	dest := t.TempDir()
+	lsn, err := ExtractSnapshot(&buf, disk, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lsn != 42 {
+		t.Errorf("extracted lsn = %d, want 42", lsn)
+	}
+	if !disk.Exists(filepath.Join(dest, "_Name.idx")) || !disk.Exists(filepath.Join(dest, "1.dat")) {
+		t.Fatal("snapshot did not restore expected files")
+	}
+}
+
+func TestWriteSnapshotWalksNestedObjectDirs(t *testing.T) {
+	src := t.TempDir()
+	disk := storage.NewDiskStorage()
+	nested := filepath.Join(src, "2", "3")
+	if err := os.MkdirAll(nested, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(nested, "2345.dat"), []byte(`{"ID":2345}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteSnapshot(&buf, disk, src, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	dest := t.TempDir()
+	if _, err := ExtractSnapshot(&buf, disk, dest); err != nil {
+		t.Fatal(err)
+	}
+	if !disk.Exists(filepath.Join(dest, "2", "3", "2345.dat")) {
+		t.Fatal("nested object file was not restored at its original path")
+	}
+}
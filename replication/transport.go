@@ -0,0 +1,93 @@
+package replication
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// Transport is how a replica reaches its primary: an initial snapshot to
+// bootstrap from, and a stream of everything after a given LSN. HTTPClient
+// is the only implementation; it's an interface so tests can fake a
+// primary without binding a real listener.
+type Transport interface {
+	FetchSnapshot() (io.ReadCloser, error)
+	OpenStream(after uint64) (io.ReadCloser, error)
+}
+
+// HTTPClient is a Transport backed by the handler Serve installs on a
+// primary: GET {BaseURL}/snapshot and GET {BaseURL}/stream?after=N.
+type HTTPClient struct {
+	BaseURL string
+	Client  *http.Client
+}
+
+func NewHTTPClient(baseURL string) *HTTPClient {
+	return &HTTPClient{BaseURL: baseURL, Client: http.DefaultClient}
+}
+
+func (c *HTTPClient) FetchSnapshot() (io.ReadCloser, error) {
+	resp, err := c.Client.Get(c.BaseURL + "/snapshot")
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("replication: snapshot request failed: %s", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+func (c *HTTPClient) OpenStream(after uint64) (io.ReadCloser, error) {
+	resp, err := c.Client.Get(c.BaseURL + "/stream?after=" + strconv.FormatUint(after, 10))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusGone {
+		resp.Body.Close()
+		return nil, &ErrGap{Requested: after}
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("replication: stream request failed: %s", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// Source is what Serve exposes a primary's snapshot and stream through; a
+// FileDB satisfies it directly.
+type Source interface {
+	Snapshot(w io.Writer) (uint64, error)
+	StreamFrom(after uint64, w io.Writer) error
+}
+
+// Serve returns an http.Handler exposing src's snapshot and stream over
+// GET /snapshot and GET /stream?after=N, for a replica's HTTPClient to
+// consume. A stream request for an LSN the primary has already truncated
+// past responds 410 Gone, which HTTPClient.OpenStream surfaces as *ErrGap
+// so the replica knows to fall back to a fresh snapshot.
+func Serve(src Source) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/snapshot", func(w http.ResponseWriter, r *http.Request) {
+		if _, err := src.Snapshot(w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+	mux.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		after, err := strconv.ParseUint(r.URL.Query().Get("after"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid after", http.StatusBadRequest)
+			return
+		}
+		err = src.StreamFrom(after, w)
+		if gap, ok := err.(*ErrGap); ok {
+			http.Error(w, gap.Error(), http.StatusGone)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+	return mux
+}
@@ -0,0 +1,14 @@
+package filedb
+
+import (
+	"net/http"
+
+	"github.com/dannyswat/filedb/replication"
+)
+
+// NewReplicationHandler exposes db's Snapshot and StreamFrom over HTTP for
+// a Replica's NewHTTPClient to consume. Mount it at the base URL passed to
+// NewReplica.
+func NewReplicationHandler[T FileEntity](db FileDB[T]) http.Handler {
+	return replication.Serve(db)
+}
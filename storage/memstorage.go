@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MemStorage is an in-memory Storage implementation used by tests that
+// don't want to touch the filesystem. It keeps one byte slice per path
+// behind a mutex; it is not meant to model every POSIX flag combination,
+// only the ones fileDB/fileIndex/fileStat actually use.
+type MemStorage struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+func NewMemStorage() *MemStorage {
+	return &MemStorage{files: make(map[string][]byte)}
+}
+
+type memFile struct {
+	storage *MemStorage
+	path    string
+	reader  *bytes.Reader
+	write   bool
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	if f.reader == nil {
+		return 0, io.EOF
+	}
+	return f.reader.Read(p)
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if !f.write {
+		return 0, fmt.Errorf("file not opened for writing: %s", f.path)
+	}
+	f.storage.mu.Lock()
+	defer f.storage.mu.Unlock()
+	f.storage.files[f.path] = append(f.storage.files[f.path], p...)
+	return len(p), nil
+}
+
+func (f *memFile) Close() error { return nil }
+func (f *memFile) Name() string { return f.path }
+
+func (s *MemStorage) Open(path string, flag int, perm os.FileMode) (File, error) {
+	s.mu.Lock()
+	data, ok := s.files[path]
+	if !ok {
+		if flag&os.O_CREATE == 0 {
+			s.mu.Unlock()
+			return nil, fmt.Errorf("file does not exist: %s", path)
+		}
+		s.files[path] = nil
+	}
+	if flag&os.O_TRUNC != 0 {
+		s.files[path] = nil
+		data = nil
+	}
+	s.mu.Unlock()
+
+	f := &memFile{storage: s, path: path}
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		f.write = true
+	}
+	if flag == os.O_RDONLY || flag&os.O_RDWR != 0 {
+		f.reader = bytes.NewReader(data)
+	}
+	return f, nil
+}
+
+func (s *MemStorage) Create(path string) (File, error) {
+	return s.Open(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+}
+
+func (s *MemStorage) Remove(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.files[path]; !ok {
+		return fmt.Errorf("file does not exist: %s", path)
+	}
+	delete(s.files, path)
+	return nil
+}
+
+func (s *MemStorage) RemoveAll(path string) error {
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for p := range s.files {
+		if p == path || strings.HasPrefix(p, prefix) {
+			delete(s.files, p)
+		}
+	}
+	return nil
+}
+
+func (s *MemStorage) List(dir string) ([]string, error) {
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen := make(map[string]bool)
+	names := make([]string, 0)
+	for path := range s.files {
+		if !strings.HasPrefix(path, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(path, prefix)
+		name := strings.SplitN(rest, "/", 2)[0]
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *MemStorage) Rename(oldPath, newPath string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.files[oldPath]
+	if !ok {
+		return fmt.Errorf("file does not exist: %s", oldPath)
+	}
+	s.files[newPath] = data
+	delete(s.files, oldPath)
+	return nil
+}
+
+func (s *MemStorage) Exists(path string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.files[path]
+	return ok
+}
+
+func (s *MemStorage) Mkdir(path string) error {
+	return nil
+}
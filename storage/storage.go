@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// File is an abstract file descriptor returned by a Storage implementation.
+type File interface {
+	io.Reader
+	io.Writer
+	io.Closer
+	Name() string
+}
+
+// Storage abstracts the disk operations used by fileDB, fileIndex and
+// fileStat so that alternative backends (in-memory, WAL-backed) can be
+// swapped in for tests or crash recovery without touching the callers.
+type Storage interface {
+	Open(path string, flag int, perm os.FileMode) (File, error)
+	Create(path string) (File, error)
+	Remove(path string) error
+	RemoveAll(path string) error
+	List(dir string) ([]string, error)
+	Rename(oldPath, newPath string) error
+	Exists(path string) bool
+	Mkdir(path string) error
+}
+
+// DiskStorage is the default Storage backed by the local filesystem; it
+// preserves the on-disk layout fileDB has always used.
+type DiskStorage struct{}
+
+func NewDiskStorage() *DiskStorage {
+	return &DiskStorage{}
+}
+
+func (s *DiskStorage) Open(path string, flag int, perm os.FileMode) (File, error) {
+	return os.OpenFile(filepath.FromSlash(path), flag, perm)
+}
+
+func (s *DiskStorage) Create(path string) (File, error) {
+	return os.Create(filepath.FromSlash(path))
+}
+
+func (s *DiskStorage) Remove(path string) error {
+	return os.Remove(filepath.FromSlash(path))
+}
+
+func (s *DiskStorage) RemoveAll(path string) error {
+	return os.RemoveAll(filepath.FromSlash(path))
+}
+
+func (s *DiskStorage) List(dir string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.FromSlash(dir))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names, nil
+}
+
+func (s *DiskStorage) Rename(oldPath, newPath string) error {
+	return os.Rename(filepath.FromSlash(oldPath), filepath.FromSlash(newPath))
+}
+
+func (s *DiskStorage) Exists(path string) bool {
+	_, err := os.Stat(filepath.FromSlash(path))
+	return !os.IsNotExist(err)
+}
+
+func (s *DiskStorage) Mkdir(path string) error {
+	if s.Exists(path) {
+		return nil
+	}
+	return os.Mkdir(filepath.FromSlash(path), 0755)
+}
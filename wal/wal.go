@@ -0,0 +1,220 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync/atomic"
+
+	"github.com/dannyswat/filedb/storage"
+)
+
+// Op identifies the kind of mutation a Record describes.
+type Op byte
+
+const (
+	OpInsert Op = 1
+	OpUpdate Op = 2
+	OpDelete Op = 3
+)
+
+// Record is a single write-ahead-log entry describing one Insert/Update/
+// Delete made to an entity before its index and object files are mutated.
+type Record struct {
+	Op   Op
+	ID   int
+	Data []byte
+}
+
+// WAL appends length-prefixed, CRC32-checksummed records to a single file
+// so a crash mid-write can be recovered from by replaying the records past
+// the last Checkpoint. A torn write at the tail (the record being appended
+// when the process died) is detected by its checksum and discarded instead
+// of failing the whole log.
+//
+// Append only writes to the process's page cache; it does not fsync. That
+// durably protects against the process crashing or being killed (the log
+// on disk, once the kernel flushes it, still has the record), but not
+// against a full power loss between the write and that flush. Nothing here
+// bounds the log's size either: it only shrinks when a caller calls
+// Checkpoint (fileDB does this automatically past an op-count threshold;
+// see checkpointOpThreshold), so a process that never checkpoints will
+// both grow the log without bound and replay its entire history on the
+// next clean restart.
+type WAL struct {
+	path    string
+	storage storage.Storage
+	file    storage.File
+	// opsSinceCheckpoint counts records appended since the log was last
+	// truncated by Checkpoint, so a caller can decide when the log has
+	// grown enough to warrant another one. Appends can run concurrently
+	// (fileDB serializes them against Checkpoint, but not against each
+	// other), so this is accessed atomically.
+	opsSinceCheckpoint int64
+}
+
+func NewWAL(path string, s storage.Storage) *WAL {
+	return &WAL{path: path, storage: s}
+}
+
+// Init opens the WAL, creating it if it doesn't exist yet, and returns the
+// records left over from the last Checkpoint so the caller can replay them
+// before accepting new writes.
+func (w *WAL) Init() ([]*Record, error) {
+	if !w.storage.Exists(w.path) {
+		file, err := w.storage.Create(w.path)
+		if err != nil {
+			return nil, err
+		}
+		w.file = file
+		return nil, nil
+	}
+
+	records, validLen, err := w.readValidPrefix()
+	if err != nil {
+		return nil, err
+	}
+	if err = w.truncateTo(validLen); err != nil {
+		return nil, err
+	}
+	file, err := w.storage.Open(w.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w.file = file
+	return records, nil
+}
+
+// Append writes rec to the tail of the log. It must be called before the
+// mutation it describes is applied to the index/object files. It does not
+// fsync (see the WAL doc comment).
+func (w *WAL) Append(rec *Record) error {
+	frame := encodeFrame(rec)
+	_, err := w.file.Write(frame)
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&w.opsSinceCheckpoint, 1)
+	return nil
+}
+
+// OpsSinceCheckpoint reports how many records have been appended since the
+// log was last truncated by Checkpoint (or since Init, if it never has).
+func (w *WAL) OpsSinceCheckpoint() int64 {
+	return atomic.LoadInt64(&w.opsSinceCheckpoint)
+}
+
+// Checkpoint truncates the log once the caller has durably rewritten the
+// index and object files, so the next Init() has nothing to replay.
+func (w *WAL) Checkpoint() error {
+	if w.file != nil {
+		w.file.Close()
+	}
+	file, err := w.storage.Create(w.path)
+	if err != nil {
+		return err
+	}
+	w.file = file
+	atomic.StoreInt64(&w.opsSinceCheckpoint, 0)
+	return nil
+}
+
+func encodeFrame(rec *Record) []byte {
+	body := make([]byte, 0, 9+len(rec.Data))
+	body = append(body, byte(rec.Op))
+	idBuf := make([]byte, 4)
+	binary.BigEndian.PutUint32(idBuf, uint32(rec.ID))
+	body = append(body, idBuf...)
+	dataLenBuf := make([]byte, 4)
+	binary.BigEndian.PutUint32(dataLenBuf, uint32(len(rec.Data)))
+	body = append(body, dataLenBuf...)
+	body = append(body, rec.Data...)
+
+	crc := crc32.ChecksumIEEE(body)
+	frame := make([]byte, 0, 4+len(body)+4)
+	lenBuf := make([]byte, 4)
+	binary.BigEndian.PutUint32(lenBuf, uint32(len(body)))
+	frame = append(frame, lenBuf...)
+	frame = append(frame, body...)
+	crcBuf := make([]byte, 4)
+	binary.BigEndian.PutUint32(crcBuf, crc)
+	frame = append(frame, crcBuf...)
+	return frame
+}
+
+// readValidPrefix reads every well-formed, checksum-valid record from the
+// start of the log and reports how many bytes that prefix occupies. Any
+// trailing bytes that don't form a complete, checksum-valid frame are
+// treated as a torn write and dropped.
+func (w *WAL) readValidPrefix() ([]*Record, int64, error) {
+	file, err := w.storage.Open(w.path, os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	records := make([]*Record, 0)
+	var offset int64
+	for {
+		if len(data) < 4 {
+			break
+		}
+		bodyLen := binary.BigEndian.Uint32(data[:4])
+		frameLen := int64(4) + int64(bodyLen) + 4
+		if int64(len(data)) < frameLen {
+			break
+		}
+		body := data[4 : 4+bodyLen]
+		wantCRC := binary.BigEndian.Uint32(data[4+bodyLen : frameLen])
+		if crc32.ChecksumIEEE(body) != wantCRC {
+			break
+		}
+		if len(body) < 9 {
+			break
+		}
+		rec := &Record{
+			Op: Op(body[0]),
+			ID: int(int32(binary.BigEndian.Uint32(body[1:5]))),
+		}
+		dataLen := binary.BigEndian.Uint32(body[5:9])
+		if uint32(len(body)-9) != dataLen {
+			break
+		}
+		rec.Data = append([]byte(nil), body[9:]...)
+		records = append(records, rec)
+
+		data = data[frameLen:]
+		offset += frameLen
+	}
+	return records, offset, nil
+}
+
+func (w *WAL) truncateTo(n int64) error {
+	file, err := w.storage.Open(w.path, os.O_RDONLY, 0644)
+	if err != nil {
+		return err
+	}
+	all, err := io.ReadAll(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	if int64(len(all)) <= n {
+		return nil
+	}
+	kept := bytes.NewReader(all[:n])
+	out, err := w.storage.Create(w.path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, kept)
+	return err
+}
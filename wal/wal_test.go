@@ -0,0 +1,211 @@
+package wal
+
+import (
+	"testing"
+
+	"github.com/dannyswat/filedb/storage"
+)
+
+func TestWALAppendAndReplay(t *testing.T) {
+	s := storage.NewMemStorage()
+	w := NewWAL("/db/_wal.log", s)
+	if _, err := w.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	records := []*Record{
+		{Op: OpInsert, ID: 1, Data: []byte(`{"ID":1,"Name":"Alice"}`)},
+		{Op: OpUpdate, ID: 1, Data: []byte(`{"ID":1,"Name":"Alice S"}`)},
+		{Op: OpDelete, ID: 1, Data: nil},
+	}
+	for _, r := range records {
+		if err := w.Append(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w2 := NewWAL("/db/_wal.log", s)
+	replayed, err := w2.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replayed) != len(records) {
+		t.Fatalf("expected %d records, got %d", len(records), len(replayed))
+	}
+	for i, r := range replayed {
+		if r.Op != records[i].Op || r.ID != records[i].ID || string(r.Data) != string(records[i].Data) {
+			t.Errorf("record %d mismatch: got %+v", i, r)
+		}
+	}
+}
+
+func TestWALCheckpointTruncates(t *testing.T) {
+	s := storage.NewMemStorage()
+	w := NewWAL("/db/_wal.log", s)
+	if _, err := w.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Append(&Record{Op: OpInsert, ID: 1, Data: []byte("x")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	w2 := NewWAL("/db/_wal.log", s)
+	replayed, err := w2.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replayed) != 0 {
+		t.Errorf("expected checkpoint to leave nothing to replay, got %d records", len(replayed))
+	}
+}
+
+// TestWALCorruptTailIsTruncated injects a torn write into the tail of the
+// log (as would be left by a crash mid-Append) and asserts replay recovers
+// every record before it and drops the corrupt remainder, and that the file
+// itself is truncated so the corrupt bytes aren't read again.
+func TestWALCorruptTailIsTruncated(t *testing.T) {
+	s := storage.NewMemStorage()
+	w := NewWAL("/db/_wal.log", s)
+	if _, err := w.Init(); err != nil {
+		t.Fatal(err)
+	}
+	good := []*Record{
+		{Op: OpInsert, ID: 1, Data: []byte("one")},
+		{Op: OpInsert, ID: 2, Data: []byte("two")},
+	}
+	for _, r := range good {
+		if err := w.Append(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Simulate a crash mid-write: append a well-formed frame, then chop off
+	// its last few bytes so the length prefix no longer matches what's on
+	// disk.
+	if err := w.Append(&Record{Op: OpInsert, ID: 3, Data: []byte("three")}); err != nil {
+		t.Fatal(err)
+	}
+	full, err := s.Open("/db/_wal.log", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf [1024]byte
+	n, _ := full.Read(buf[:])
+	corrupted := append([]byte(nil), buf[:n-3]...)
+	if err := s.Remove("/db/_wal.log"); err != nil {
+		t.Fatal(err)
+	}
+	out, err := s.Create("/db/_wal.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := out.Write(corrupted); err != nil {
+		t.Fatal(err)
+	}
+	out.Close()
+
+	w2 := NewWAL("/db/_wal.log", s)
+	replayed, err := w2.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replayed) != len(good) {
+		t.Fatalf("expected %d recovered records, got %d", len(good), len(replayed))
+	}
+	for i, r := range replayed {
+		if r.ID != good[i].ID || string(r.Data) != string(good[i].Data) {
+			t.Errorf("record %d mismatch: got %+v", i, r)
+		}
+	}
+
+	// Appending after recovery should not resurrect the corrupt tail.
+	if err := w2.Append(&Record{Op: OpInsert, ID: 4, Data: []byte("four")}); err != nil {
+		t.Fatal(err)
+	}
+	w3 := NewWAL("/db/_wal.log", s)
+	replayed2, err := w3.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replayed2) != 3 {
+		t.Fatalf("expected 3 records after recovery + append, got %d", len(replayed2))
+	}
+}
+
+// TestWALCorruptMidFrameByteIsTruncated injects a single bit flip inside an
+// otherwise complete, correctly-length-prefixed frame — as a bad disk
+// sector or a torn write that happened to land mid-body could leave —
+// instead of chopping the tail. readValidPrefix must catch this via the
+// CRC, not just the length prefix TestWALCorruptTailIsTruncated exercises.
+func TestWALCorruptMidFrameByteIsTruncated(t *testing.T) {
+	s := storage.NewMemStorage()
+	w := NewWAL("/db/_wal.log", s)
+	if _, err := w.Init(); err != nil {
+		t.Fatal(err)
+	}
+	good := []*Record{
+		{Op: OpInsert, ID: 1, Data: []byte("one")},
+		{Op: OpInsert, ID: 2, Data: []byte("two")},
+	}
+	for _, r := range good {
+		if err := w.Append(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Append(&Record{Op: OpInsert, ID: 3, Data: []byte("three")}); err != nil {
+		t.Fatal(err)
+	}
+
+	full, err := s.Open("/db/_wal.log", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf [1024]byte
+	n, _ := full.Read(buf[:])
+	corrupted := append([]byte(nil), buf[:n]...)
+	// Flip a byte inside the last frame's body (past the two good frames'
+	// length+body+crc) without touching its length prefix, so the frame
+	// still looks complete and only the checksum catches it.
+	lastFrameStart := len(corrupted) - (4 + (9 + len("three")) + 4)
+	corrupted[lastFrameStart+4] ^= 0xFF
+	if err := s.Remove("/db/_wal.log"); err != nil {
+		t.Fatal(err)
+	}
+	out, err := s.Create("/db/_wal.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := out.Write(corrupted); err != nil {
+		t.Fatal(err)
+	}
+	out.Close()
+
+	w2 := NewWAL("/db/_wal.log", s)
+	replayed, err := w2.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replayed) != len(good) {
+		t.Fatalf("expected %d recovered records, got %d", len(good), len(replayed))
+	}
+	for i, r := range replayed {
+		if r.ID != good[i].ID || string(r.Data) != string(good[i].Data) {
+			t.Errorf("record %d mismatch: got %+v", i, r)
+		}
+	}
+
+	// Appending after recovery should not resurrect the corrupt frame.
+	if err := w2.Append(&Record{Op: OpInsert, ID: 4, Data: []byte("four")}); err != nil {
+		t.Fatal(err)
+	}
+	w3 := NewWAL("/db/_wal.log", s)
+	replayed2, err := w3.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replayed2) != 3 {
+		t.Fatalf("expected 3 records after recovery + append, got %d", len(replayed2))
+	}
+}